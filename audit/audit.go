@@ -0,0 +1,193 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Ref update actions
+const (
+	ActionPushed  = "pushed"
+	ActionSkipped = "skipped"
+	ActionDeleted = "deleted"
+	ActionFailed  = "failed"
+)
+
+// DefaultRecords is how many records are kept in memory to be queried by default
+const DefaultRecords = 1000
+
+// Update sources
+const (
+	SourceWebhook   = "webhook"
+	SourceSignal    = "USR2"
+	SourcePoll      = "poll"
+	SourceReconcile = "reconcile"
+	SourceAPI       = "api"
+	SourceResume    = "resume"
+	SourceRestart   = "restart"
+	SourceRecovered = "recovered"
+)
+
+// RefUpdate is what happened to a single ref in an update
+type RefUpdate struct {
+	Ref    string `json:"ref"`
+	Old    string `json:"old,omitempty"`
+	New    string `json:"new,omitempty"`
+	Action string `json:"action"`
+}
+
+// Record is the result of a single repository update
+type Record struct {
+	Time            time.Time   `json:"time"`
+	RequestID       string      `json:"request_id"`
+	Repo            string      `json:"repo"`
+	Key             string      `json:"key,omitempty"`
+	Source          string      `json:"source"`
+	Refs            []RefUpdate `json:"refs"`
+	DurationSeconds float64     `json:"duration_seconds"`
+	Error           string      `json:"error,omitempty"`
+	// Paused is set when the repository was paused, so the update was only recorded
+	Paused bool `json:"paused,omitempty"`
+}
+
+// Log is an append only log of records. Records are written to a JSON lines
+// file when one is set, and the last ones are kept in memory to be queried.
+type Log struct {
+	lock *sync.Mutex
+
+	file    *os.File
+	keep    int
+	records []Record
+}
+
+// New creates a new audit log that appends to the given file, if any, and
+// keeps the last records in memory, loading them from the file when it exists
+func New(filename string, keep int) (*Log, error) {
+	l := &Log{
+		lock:    &sync.Mutex{},
+		keep:    keep,
+		records: make([]Record, 0),
+	}
+	if filename == "" {
+		return l, nil
+	}
+
+	if err := l.load(filename); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log %s: %s", filename, err)
+	}
+	l.file = f
+
+	return l, nil
+}
+
+func (l *Log) load(filename string) error {
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read audit log %s: %s", filename, err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var r Record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			logrus.Warnf("skipping invalid audit record in %s:%d: %s", filename, line, err)
+			continue
+		}
+		l.append(r)
+	}
+	return scanner.Err()
+}
+
+// Write appends a record to the log
+func (l *Log) Write(r Record) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.append(r)
+
+	if l.file == nil {
+		return
+	}
+
+	b, err := json.Marshal(r)
+	if err != nil {
+		logrus.Errorf("failed to marshal audit record for request %s: %s", r.RequestID, err)
+		return
+	}
+	if _, err = l.file.Write(append(b, '\n')); err != nil {
+		logrus.Errorf("failed to write audit record for request %s: %s", r.RequestID, err)
+	}
+}
+
+func (l *Log) append(r Record) {
+	l.records = append(l.records, r)
+	if l.keep > 0 && len(l.records) > l.keep {
+		l.records = l.records[len(l.records)-l.keep:]
+	}
+}
+
+// key returns the owner/name key of the repository, derived from the repo path
+// for the records written before the key was recorded
+func (r Record) key() string {
+	if r.Key != "" {
+		return r.Key
+	}
+	parts := strings.Split(r.Repo, "/")
+	if len(parts) < 2 {
+		return r.Repo
+	}
+	return path.Join(parts[len(parts)-2:]...)
+}
+
+// Query returns the last records, newest first, optionally filtered by repo,
+// either its owner/name key or its full path, and request id. A limit of 0
+// returns all the records in memory.
+func (l *Log) Query(repo, requestID string, limit int) []Record {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	result := make([]Record, 0)
+	for i := len(l.records) - 1; i >= 0; i-- {
+		r := l.records[i]
+		if repo != "" && r.key() != repo && r.Repo != repo {
+			continue
+		}
+		if requestID != "" && r.RequestID != requestID {
+			continue
+		}
+		result = append(result, r)
+		if limit > 0 && len(result) >= limit {
+			break
+		}
+	}
+	return result
+}
+
+// Close closes the underlying file
+func (l *Log) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+	return l.file.Close()
+}
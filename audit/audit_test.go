@@ -0,0 +1,109 @@
+package audit_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gitlab.com/yakshaving.art/git-pull-mirror/audit"
+)
+
+func TestRecordsAreQueriedNewestFirst(t *testing.T) {
+	l, err := audit.New("", 3)
+	must(t, "failed to create audit log", err)
+
+	for i := 0; i < 5; i++ {
+		l.Write(audit.Record{RequestID: fmt.Sprintf("%d", i), Repo: fmt.Sprintf("repo-%d", i%2)})
+	}
+
+	tt := []struct {
+		name      string
+		repo      string
+		requestID string
+		limit     int
+		expected  []string
+	}{
+		{"all", "", "", 0, []string{"4", "3", "2"}},
+		{"limited", "", "", 2, []string{"4", "3"}},
+		{"by repo", "repo-0", "", 0, []string{"4", "2"}},
+		{"by request id", "", "3", 0, []string{"3"}},
+		{"evicted request id", "", "1", 0, []string{}},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			got := make([]string, 0)
+			for _, r := range l.Query(tc.repo, tc.requestID, tc.limit) {
+				got = append(got, r.RequestID)
+			}
+			assertEquals(t, fmt.Sprintf("%v", tc.expected), fmt.Sprintf("%v", got))
+		})
+	}
+}
+
+func TestRecordsAreQueriedByRepoKeyOrPath(t *testing.T) {
+	l, err := audit.New("", 10)
+	must(t, "failed to create audit log", err)
+
+	l.Write(audit.Record{RequestID: "old", Repo: "github.com/owner/repo"})
+	l.Write(audit.Record{RequestID: "new", Repo: "github.com/owner/repo", Key: "owner/repo"})
+	l.Write(audit.Record{RequestID: "other", Repo: "github.com/owner/other", Key: "owner/other"})
+
+	for _, repo := range []string{"owner/repo", "github.com/owner/repo"} {
+		got := make([]string, 0)
+		for _, r := range l.Query(repo, "", 0) {
+			got = append(got, r.RequestID)
+		}
+		assertEquals(t, "[new old]", fmt.Sprintf("%v", got))
+	}
+}
+
+func TestRecordsAreAppendedToTheFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	must(t, "failed to create temp dir", err)
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "audit.jsonl")
+
+	l, err := audit.New(filename, 10)
+	must(t, "failed to create audit log", err)
+	l.Write(audit.Record{
+		Time:      time.Unix(0, 0).UTC(),
+		RequestID: "first",
+		Repo:      "github.com/owner/repo",
+		Source:    audit.SourceWebhook,
+		Refs:      []audit.RefUpdate{{Ref: "refs/heads/master", Old: "a", New: "b", Action: audit.ActionPushed}},
+	})
+	must(t, "failed to close audit log", l.Close())
+
+	l, err = audit.New(filename, 10)
+	must(t, "failed to reopen audit log", err)
+	l.Write(audit.Record{Time: time.Unix(0, 0).UTC(), RequestID: "second", Repo: "github.com/owner/repo", Source: audit.SourcePoll, Error: "failed to fetch"})
+	must(t, "failed to close audit log", l.Close())
+
+	b, err := ioutil.ReadFile(filename)
+	must(t, "failed to read audit log", err)
+	assertEquals(t, `{"time":"1970-01-01T00:00:00Z","request_id":"first","repo":"github.com/owner/repo","source":"webhook","refs":[{"ref":"refs/heads/master","old":"a","new":"b","action":"pushed"}],"duration_seconds":0}
+{"time":"1970-01-01T00:00:00Z","request_id":"second","repo":"github.com/owner/repo","source":"poll","refs":null,"duration_seconds":0,"error":"failed to fetch"}
+`, string(b))
+
+	records := l.Query("", "", 0)
+	if len(records) != 2 {
+		t.Fatalf("Expected the reopened log to have 2 records, got %d", len(records))
+	}
+}
+
+func must(t *testing.T, msg string, err error) {
+	if err != nil {
+		t.Fatalf("%s: %s", msg, err)
+	}
+}
+
+func assertEquals(t *testing.T, expected, got string) {
+	if expected != got {
+		t.Fatalf("Expected %s, got %s", expected, got)
+	}
+}
@@ -1,12 +1,17 @@
 package config
 
 import (
+	"crypto/sha256"
 	"fmt"
 	"io/ioutil"
+	"net"
 	neturl "net/url"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
 
+	"github.com/robfig/cron"
 	"github.com/sirupsen/logrus"
 
 	"gitlab.com/yakshaving.art/git-pull-mirror/url"
@@ -15,19 +20,74 @@ import (
 
 // Config holds the configuration of the application
 type Config struct {
+	// Defaults apply to the repositories of the file and the files it includes
+	Defaults Defaults `yaml:"defaults,omitempty"`
+	// Include are more configuration files, directories or globs to load,
+	// relative to the file that includes them
+	Include      []string           `yaml:"include,omitempty"`
 	Repositories []RepositoryConfig `yaml:"repositories"`
+
+	// Files are the files the configuration was loaded from, in order
+	Files []string `yaml:"-"`
+	// Paths are the configuration path and the includes, as files,
+	// directories or globs, that the files were resolved from
+	Paths []string `yaml:"-"`
 }
 
 // RepositoryConfig holds the repository origin url, git origin parsing and
 // target url
 type RepositoryConfig struct {
-	Origin    string `yaml:"origin"`
-	OriginURL url.GitURL
+	Origin    string     `yaml:"origin"`
+	OriginURL url.GitURL `yaml:"-"`
+
+	Target    string     `yaml:"target,omitempty"`
+	TargetURL url.GitURL `yaml:"-"`
+
+	// PollInterval is how often to check the origin for changes, 0 to rely on webhooks only
+	PollInterval time.Duration `yaml:"poll_interval,omitempty"`
+
+	// OnDivergence is what to do when the target has commits the origin doesn't: overwrite, skip or alert
+	OnDivergence string `yaml:"on_divergence,omitempty"`
+
+	// PruneTarget deletes from the target the branches and tags that are not in the origin
+	PruneTarget bool `yaml:"prune_target,omitempty"`
 
-	Target    string `yaml:"target"`
-	TargetURL url.GitURL
+	// BackupRewrites pushes the old tip of the branches force pushed in origin to refs/mirror-backup/ in target
+	BackupRewrites bool `yaml:"backup_rewrites,omitempty"`
+
+	// Paused stops fetching and pushing the repository, the updates are only recorded until it is resumed
+	Paused bool `yaml:"paused,omitempty"`
+
+	// Credentials authenticate against the origin and the target instead of the default ones
+	Credentials *Credentials `yaml:"credentials,omitempty"`
+	// Auth are the credentials in use, either the repository or the default ones
+	Auth Credentials `yaml:"-"`
+
+	// Refs only mirrors the branches and tags matching any of these patterns instead of the default ones
+	Refs []string `yaml:"refs,omitempty"`
+	// RefFilters are the patterns in use, either the repository or the default ones
+	RefFilters []string `yaml:"-"`
+
+	// File and Line are where the repository is defined, when it was loaded from a file
+	File string `yaml:"-"`
+	Line int    `yaml:"-"`
 }
 
+// Source returns where the repository is defined as file:line, if known
+func (r RepositoryConfig) Source() string {
+	if r.Line == 0 {
+		return r.File
+	}
+	return fmt.Sprintf("%s:%d", r.File, r.Line)
+}
+
+// Divergence policies
+const (
+	DivergenceOverwrite = "overwrite"
+	DivergenceSkip      = "skip"
+	DivergenceAlert     = "alert"
+)
+
 // Arguments parsed through user provided flags
 type Arguments struct {
 	Address      string
@@ -36,79 +96,201 @@ type Arguments struct {
 	Debug        bool
 	PprofAddress string
 
-	GithubUser  string
-	GithubToken string
-	GithubURL   string
+	GithubUser       string
+	GithubToken      string
+	GithubURL        string
+	GithubAPIURL     string
+	GithubCAFile     string
+	GithubClientCert string
+	GithubClientKey  string
+
+	APITimeoutSeconds uint64
+	APIConcurrency    int
+
+	TLSCert             string
+	TLSKey              string
+	TLSClientCA         string
+	ReadTimeoutSeconds  uint64
+	WriteTimeoutSeconds uint64
+	IdleTimeoutSeconds  uint64
+
+	AdminAddress       string
+	AdminTLSCert       string
+	AdminTLSKey        string
+	AdminClientCA      string
+	AdminToken         string
+	AdminReadOnlyToken string
+	AdminOperatorCNs   string
+	AdminReadOnlyCNs   string
+	MetricsToken       string
+	MetricsClientCNs   string
+	DashboardToken     string
+	DashboardClientCNs string
+	PprofToken         string
+	PprofClientCNs     string
+
+	WebhooksTarget        string
+	WebhooksVerifySeconds uint64
+	PollIntervalSeconds   uint64
+	ReconcileSchedule     string
+	AuditFile             string
+	RepositoriesPath      string
+	SSHKey                string
+	TimeoutSeconds        uint64
+
+	ShutdownTimeoutSeconds uint64
+	QueueFile              string
 
-	WebhooksTarget   string
-	RepositoriesPath string
-	SSHKey           string
-	TimeoutSeconds   uint64
+	WebhooksAllowCIDRs       string
+	WebhooksTrustedProxies   string
+	GithubMetaFile           string
+	GithubMetaRefreshSeconds uint64
 
 	DryRun      bool
 	ShowVersion bool
+	PruneHooks  bool
 
-	Concurrency int
+	Concurrency       int
+	ConfigConcurrency int
+	ConfigStrict      bool
+	ConfigWatch       bool
 }
 
-// LoadConfiguration loads the file and parses the origin url, returns a
-// configuration if everything checks up, an error in case of any failure.
-func LoadConfiguration(filename string) (Config, error) {
-	logrus.Debugf("reading configuration file %s", filename)
-	b, err := ioutil.ReadFile(filename)
-	if err != nil {
-		return Config{}, fmt.Errorf("failed reading configuration file %s: %s", filename, err)
+// LoadConfiguration loads the configuration from a file, every *.yml file in
+// a directory or the files matching a glob, following their includes, and
+// parses the repositories. It returns a configuration if everything checks up,
+// an error in case of any failure, including repositories defined twice.
+func LoadConfiguration(path string) (Config, error) {
+	l := newLoader()
+	if err := l.loadPath(path, Defaults{}); err != nil {
+		return Config{}, err
 	}
+	return l.config, nil
+}
 
-	c := Config{}
-	if err = yaml.Unmarshal(b, &c); err != nil {
-		return c, fmt.Errorf("failed to parse configuration file %s: %s", filename, err)
+// Parse parses the origin and target urls of the repository, validates it and
+// sets the defaults of the options that are not set
+func (r *RepositoryConfig) Parse() error {
+	return r.ParseWithDefaults(Defaults{})
+}
+
+// ParseWithDefaults parses the repository as Parse does, rendering the target
+// from the target template when it is not set and using the default
+// credentials and ref filters when it doesn't have its own
+func (r *RepositoryConfig) ParseWithDefaults(d Defaults) error {
+	origin, err := url.Parse(r.Origin)
+	if err != nil {
+		return fmt.Errorf("failed to parse origin url %s: %s", r.Origin, err)
 	}
+	r.OriginURL = origin
 
-	for i, repo := range c.Repositories {
-		origin, err := url.Parse(repo.Origin)
-		if err != nil {
-			return c, fmt.Errorf("failed to parse origin url %s: %s", repo.Origin, err)
+	target := r.Target
+	if target == "" && d.TargetTemplate != "" {
+		if target, err = d.renderTarget(origin); err != nil {
+			return err
 		}
-		c.Repositories[i].OriginURL = origin
+	}
+	r.TargetURL, err = url.Parse(target)
+	if err != nil {
+		return fmt.Errorf("failed to parse target url %s: %s", target, err)
+	}
 
-		target, err := url.Parse(repo.Target)
-		if err != nil {
-			return c, fmt.Errorf("failed to parse target url %s: %s", repo.Target, err)
-		}
-		c.Repositories[i].TargetURL = target
+	r.Auth = Credentials{}
+	if r.Credentials != nil {
+		r.Auth = *r.Credentials
+	} else if d.Credentials != nil {
+		r.Auth = *d.Credentials
 	}
 
-	return c, nil
-}
+	r.RefFilters = r.Refs
+	if len(r.RefFilters) == 0 {
+		r.RefFilters = d.Refs
+	}
+	if err = checkRefFilters(r.RefFilters, r.Origin); err != nil {
+		return err
+	}
 
-// Check runs the arguments structure through a validation. It returns an error if the arguments are invalid.
-func (a Arguments) Check() error {
-	if strings.TrimSpace(a.ConfigFile) == "" {
-		return fmt.Errorf("Config file is mandatory, please set it through the -config.file argument")
+	if r.PollInterval < 0 {
+		return fmt.Errorf("invalid poll interval %s for %s, it should be positive", r.PollInterval, r.Origin)
 	}
-	if strings.TrimSpace(a.CallbackURL) == "" {
-		return fmt.Errorf("Callback URL is mandatory, please set it through the environment CALLBACK_URL variable or with -callback.url")
+
+	switch r.OnDivergence {
+	case "", DivergenceOverwrite, DivergenceSkip, DivergenceAlert:
+	default:
+		return fmt.Errorf("invalid on_divergence %s for %s, it should be one of %s, %s or %s",
+			r.OnDivergence, r.Origin, DivergenceOverwrite, DivergenceSkip, DivergenceAlert)
 	}
 
-	u, err := neturl.ParseRequestURI(a.CallbackURL)
+	return nil
+}
+
+// WriteConfiguration writes the configuration to the file atomically, through
+// a temporary file in the same folder that is renamed over the original one
+func WriteConfiguration(filename string, c Config) error {
+	b, err := yaml.Marshal(c)
 	if err != nil {
-		return fmt.Errorf("Invalid callback URL '%s': %s", a.CallbackURL, err)
+		return fmt.Errorf("failed to marshal configuration: %s", err)
 	}
-	if strings.TrimSpace(u.Scheme) == "" || strings.TrimSpace(u.Path) == "" || strings.TrimSpace(u.Host) == "" {
-		return fmt.Errorf("Invalid callback URL '%s', it should include a path", a.CallbackURL)
+
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename))
+	if err != nil {
+		return fmt.Errorf("failed to create temporary configuration file: %s", err)
 	}
+	defer os.Remove(tmp.Name())
 
-	if len(strings.TrimSpace(a.GithubUser)) == 0 {
-		return fmt.Errorf("GitHub user is mandatory, please set it through the environment GITHUB_USER variable or with -github.user")
+	if _, err = tmp.Write(append([]byte("---\n"), b...)); err == nil {
+		err = tmp.Sync()
 	}
-	if len(strings.TrimSpace(a.GithubToken)) == 0 {
-		return fmt.Errorf("GitHubToken user is mandatory, please set it through the environment GITHUB_TOKEN variable or with -github.token")
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write temporary configuration file %s: %s", tmp.Name(), err)
 	}
 
-	u, err = neturl.ParseRequestURI(a.GithubURL)
+	if info, err := os.Stat(filename); err == nil {
+		os.Chmod(tmp.Name(), info.Mode())
+	}
+
+	if err = os.Rename(tmp.Name(), filename); err != nil {
+		return fmt.Errorf("failed to replace configuration file %s: %s", filename, err)
+	}
+	return nil
+}
+
+// ETag returns an identifier of the configuration contents, used to detect
+// concurrent changes
+func (c Config) ETag() string {
+	b, err := yaml.Marshal(c)
 	if err != nil {
-		return fmt.Errorf("Invalid GitHub URL '%s': %s", a.GithubURL, err)
+		return ""
+	}
+	return fmt.Sprintf(`"%x"`, sha256.Sum256(b))
+}
+
+// Webhooks targets
+const (
+	GitHubWebhooksTarget = "github"
+	NoWebhooksTarget     = "none"
+)
+
+// Check runs the arguments structure through a validation. It returns an error if the arguments are invalid.
+func (a Arguments) Check() error {
+	if strings.TrimSpace(a.ConfigFile) == "" {
+		return fmt.Errorf("Config file is mandatory, please set it through the -config.file argument")
+	}
+
+	switch a.WebhooksTarget {
+	case GitHubWebhooksTarget, "":
+		if err := a.checkGitHub(); err != nil {
+			return err
+		}
+	case NoWebhooksTarget:
+		if a.PollIntervalSeconds == 0 {
+			logrus.Warnf("webhooks are disabled and there is no default poll interval, only repositories with poll_interval will be kept up to date")
+		}
+	default:
+		return fmt.Errorf("Invalid webhooks target '%s', it should be either %s or %s", a.WebhooksTarget, GitHubWebhooksTarget, NoWebhooksTarget)
 	}
 
 	f, err := os.Stat(a.RepositoriesPath)
@@ -132,5 +314,155 @@ func (a Arguments) Check() error {
 		return fmt.Errorf("Invalid concurrency %d, it has to be 1 or higher", a.Concurrency)
 	}
 
+	if a.APITimeoutSeconds <= 0 {
+		return fmt.Errorf("Invalid api timeout seconds %d, it should be 1 or higher", a.APITimeoutSeconds)
+	}
+	if a.APIConcurrency <= 0 {
+		return fmt.Errorf("Invalid api concurrency %d, it has to be 1 or higher", a.APIConcurrency)
+	}
+	if a.ConfigConcurrency <= 0 {
+		return fmt.Errorf("Invalid config concurrency %d, it has to be 1 or higher", a.ConfigConcurrency)
+	}
+
+	if strings.TrimSpace(a.ReconcileSchedule) != "" {
+		if _, err := cron.ParseStandard(a.ReconcileSchedule); err != nil {
+			return fmt.Errorf("Invalid reconcile schedule '%s': %s", a.ReconcileSchedule, err)
+		}
+	}
+
+	if err := a.checkAllowlist(); err != nil {
+		return err
+	}
+	if err := a.checkTLS(); err != nil {
+		return err
+	}
+	return a.checkAdmin()
+}
+
+// checkAllowlist validates the ranges webhooks are accepted from
+func (a Arguments) checkAllowlist() error {
+	for _, cidrs := range []string{a.WebhooksAllowCIDRs, a.WebhooksTrustedProxies} {
+		for _, cidr := range strings.Split(cidrs, ",") {
+			if strings.TrimSpace(cidr) == "" {
+				continue
+			}
+			if _, _, err := net.ParseCIDR(strings.TrimSpace(cidr)); err != nil {
+				return fmt.Errorf("Invalid CIDR range '%s': %s", cidr, err)
+			}
+		}
+	}
+	if a.GithubMetaRefreshSeconds > 0 && a.WebhooksTarget == NoWebhooksTarget {
+		return fmt.Errorf("GitHub meta can only be refreshed with the github webhooks target")
+	}
+	return nil
+}
+
+// checkTLS validates the tls arguments of the webhooks listener
+func (a Arguments) checkTLS() error {
+	if (strings.TrimSpace(a.TLSCert) == "") != (strings.TrimSpace(a.TLSKey) == "") {
+		return fmt.Errorf("TLS certificate and key have to be set together")
+	}
+	if strings.TrimSpace(a.TLSClientCA) != "" && strings.TrimSpace(a.TLSCert) == "" {
+		return fmt.Errorf("TLS client CA requires a TLS certificate, please set it with -tls.cert")
+	}
+	for _, f := range []string{a.TLSCert, a.TLSKey, a.TLSClientCA} {
+		if strings.TrimSpace(f) == "" {
+			continue
+		}
+		if _, err := os.Stat(f); err != nil {
+			return fmt.Errorf("TLS file is not accessible: %s", err)
+		}
+	}
+	return nil
+}
+
+// checkAdmin validates the arguments of the admin listener and its access rules
+func (a Arguments) checkAdmin() error {
+	if strings.TrimSpace(a.AdminAddress) == "" && (a.AdminTLSCert != "" || a.AdminClientCA != "") {
+		return fmt.Errorf("Admin TLS requires an admin listener, please set it with -admin.address")
+	}
+	if (strings.TrimSpace(a.AdminTLSCert) == "") != (strings.TrimSpace(a.AdminTLSKey) == "") {
+		return fmt.Errorf("Admin TLS certificate and key have to be set together")
+	}
+	if strings.TrimSpace(a.AdminClientCA) != "" && strings.TrimSpace(a.AdminTLSCert) == "" {
+		return fmt.Errorf("Admin client CA requires an admin TLS certificate, please set it with -admin.tls.cert")
+	}
+	for _, f := range []string{a.AdminTLSCert, a.AdminTLSKey, a.AdminClientCA} {
+		if strings.TrimSpace(f) == "" {
+			continue
+		}
+		if _, err := os.Stat(f); err != nil {
+			return fmt.Errorf("Admin TLS file is not accessible: %s", err)
+		}
+	}
+
+	for _, cns := range []string{a.AdminOperatorCNs, a.AdminReadOnlyCNs, a.MetricsClientCNs, a.DashboardClientCNs, a.PprofClientCNs} {
+		if strings.TrimSpace(cns) != "" && strings.TrimSpace(a.AdminClientCA) == "" {
+			return fmt.Errorf("Client certificate common names require an admin client CA, please set it with -admin.tls.client.ca")
+		}
+	}
+	return nil
+}
+
+// checkGitHub validates the arguments needed to register webhooks in GitHub
+func (a Arguments) checkGitHub() error {
+	if strings.TrimSpace(a.CallbackURL) == "" {
+		return fmt.Errorf("Callback URL is mandatory, please set it through the environment CALLBACK_URL variable or with -callback.url")
+	}
+
+	u, err := neturl.ParseRequestURI(a.CallbackURL)
+	if err != nil {
+		return fmt.Errorf("Invalid callback URL '%s': %s", a.CallbackURL, err)
+	}
+	if strings.TrimSpace(u.Scheme) == "" || strings.TrimSpace(u.Path) == "" || strings.TrimSpace(u.Host) == "" {
+		return fmt.Errorf("Invalid callback URL '%s', it should include a path", a.CallbackURL)
+	}
+
+	if len(strings.TrimSpace(a.GithubUser)) == 0 {
+		return fmt.Errorf("GitHub user is mandatory, please set it through the environment GITHUB_USER variable or with -github.user")
+	}
+	if len(strings.TrimSpace(a.GithubToken)) == 0 {
+		return fmt.Errorf("GitHubToken user is mandatory, please set it through the environment GITHUB_TOKEN variable or with -github.token")
+	}
+
+	// The api url is derived from the hub url when it is not set, and the
+	// other way around, so both need a schema and domain
+	if strings.TrimSpace(a.GithubAPIURL) != "" {
+		u, err = neturl.ParseRequestURI(a.GithubAPIURL)
+		if err != nil {
+			return fmt.Errorf("Invalid GitHub API URL '%s': %s", a.GithubAPIURL, err)
+		}
+		if strings.TrimSpace(u.Scheme) == "" || strings.TrimSpace(u.Host) == "" {
+			return fmt.Errorf("Invalid GitHub API URL '%s', it should include schema and domain", a.GithubAPIURL)
+		}
+	}
+
+	if strings.TrimSpace(a.GithubURL) != "" {
+		u, err = neturl.ParseRequestURI(a.GithubURL)
+		if err != nil {
+			return fmt.Errorf("Invalid GitHub URL '%s': %s", a.GithubURL, err)
+		}
+		if strings.TrimSpace(u.Scheme) == "" || strings.TrimSpace(u.Host) == "" {
+			return fmt.Errorf("Invalid GitHub URL '%s', it should include schema and domain", a.GithubURL)
+		}
+	}
+
+	if strings.TrimSpace(a.GithubCAFile) != "" {
+		if _, err := os.Stat(a.GithubCAFile); err != nil {
+			return fmt.Errorf("GitHub CA file is not accessible: %s", err)
+		}
+	}
+	if (strings.TrimSpace(a.GithubClientCert) == "") != (strings.TrimSpace(a.GithubClientKey) == "") {
+		return fmt.Errorf("GitHub client certificate and key have to be set together")
+	}
+	for _, f := range []string{a.GithubClientCert, a.GithubClientKey} {
+		if strings.TrimSpace(f) == "" {
+			continue
+		}
+		if _, err := os.Stat(f); err != nil {
+			return fmt.Errorf("GitHub client certificate file is not accessible: %s", err)
+		}
+	}
+
 	return nil
 }
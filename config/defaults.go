@@ -0,0 +1,108 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"gitlab.com/yakshaving.art/git-pull-mirror/url"
+)
+
+// Defaults are applied to the repositories that don't set their own target,
+// credentials or ref filters
+type Defaults struct {
+	// TargetTemplate renders the target of the repositories without one, it is
+	// a Go template over the origin url fields like Domain, Owner and Name
+	TargetTemplate string `yaml:"target_template,omitempty"`
+
+	// Credentials authenticate against the origins and the targets
+	Credentials *Credentials `yaml:"credentials,omitempty"`
+
+	// Refs are the patterns of the branches and tags to mirror
+	Refs []string `yaml:"refs,omitempty"`
+}
+
+// Credentials authenticate against the origin and the target separately, so
+// the ones of a host are never sent to the other
+type Credentials struct {
+	Origin *RemoteCredentials `yaml:"origin,omitempty"`
+	Target *RemoteCredentials `yaml:"target,omitempty"`
+}
+
+// RemoteCredentials authenticate against a remote, the username and the
+// password read from the password file are used for http remotes and the ssh
+// key for ssh ones, which falls back to the global ssh key
+type RemoteCredentials struct {
+	Username     string `yaml:"username,omitempty"`
+	PasswordFile string `yaml:"password_file,omitempty"`
+	SSHKey       string `yaml:"ssh_key,omitempty"`
+}
+
+// merge returns the defaults overridden by the ones that are set in other
+func (d Defaults) merge(other Defaults) Defaults {
+	if other.TargetTemplate != "" {
+		d.TargetTemplate = other.TargetTemplate
+	}
+	if other.Credentials != nil {
+		d.Credentials = other.Credentials
+	}
+	if len(other.Refs) > 0 {
+		d.Refs = other.Refs
+	}
+	return d
+}
+
+// check validates the target template and the ref filters
+func (d Defaults) check() error {
+	if d.TargetTemplate != "" {
+		if _, err := template.New("target").Parse(d.TargetTemplate); err != nil {
+			return fmt.Errorf("invalid target_template %s: %s", d.TargetTemplate, err)
+		}
+	}
+	return checkRefFilters(d.Refs, "the defaults")
+}
+
+// renderTarget renders the target template for the origin
+func (d Defaults) renderTarget(origin url.GitURL) (string, error) {
+	t, err := template.New("target").Parse(d.TargetTemplate)
+	if err != nil {
+		return "", fmt.Errorf("invalid target_template %s: %s", d.TargetTemplate, err)
+	}
+
+	b := &bytes.Buffer{}
+	if err = t.Execute(b, origin); err != nil {
+		return "", fmt.Errorf("failed to render target_template for %s: %s", origin, err)
+	}
+	return b.String(), nil
+}
+
+// checkRefFilters validates that the ref filters are full ref names
+func checkRefFilters(filters []string, owner string) error {
+	for _, filter := range filters {
+		if !strings.HasPrefix(filter, "refs/") {
+			return fmt.Errorf("invalid ref filter %s for %s, it should be a full ref name like refs/heads/* or refs/tags/v*", filter, owner)
+		}
+	}
+	return nil
+}
+
+// MatchesRefs returns whether the ref name matches any of the filters, where *
+// matches anything, including slashes, as in git refspecs. Every ref matches
+// when there are no filters.
+func MatchesRefs(filters []string, name string) bool {
+	if len(filters) == 0 {
+		return true
+	}
+	for _, filter := range filters {
+		parts := strings.Split(filter, "*")
+		for i := range parts {
+			parts[i] = regexp.QuoteMeta(parts[i])
+		}
+		if regexp.MustCompile("^" + strings.Join(parts, ".*") + "$").MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
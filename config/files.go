@@ -0,0 +1,181 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// topLevelKey matches the keys at the root of a configuration file and
+// sequenceItem the items of a sequence, to find the line in which every
+// repository of the repositories sequence is defined
+var (
+	topLevelKey  = regexp.MustCompile(`^["']?([\w-]+)["']?\s*:`)
+	sequenceItem = regexp.MustCompile(`^(\s*)-(\s|$)`)
+)
+
+// configurationFiles resolves the configuration path, which can be a file, a
+// directory whose *.yml files are loaded or a glob, to the files to load in order
+func configurationFiles(path string) ([]string, error) {
+	if strings.ContainsAny(path, "*?[") {
+		files, err := filepath.Glob(path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid configuration glob %s: %s", path, err)
+		}
+		if len(files) == 0 {
+			return nil, fmt.Errorf("no configuration files match %s", path)
+		}
+		sort.Strings(files)
+		return files, nil
+	}
+
+	if info, err := os.Stat(path); err != nil || !info.IsDir() {
+		return []string{path}, nil
+	}
+
+	files, err := filepath.Glob(filepath.Join(path, "*.yml"))
+	if err != nil {
+		return nil, fmt.Errorf("failed listing configuration directory %s: %s", path, err)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// loader merges the configuration files, following their includes
+type loader struct {
+	config Config
+	loaded map[string]bool
+}
+
+func newLoader() *loader {
+	return &loader{
+		config: Config{Repositories: make([]RepositoryConfig, 0)},
+		loaded: make(map[string]bool),
+	}
+}
+
+// loadPath loads all the configuration files of the path with the inherited defaults
+func (l *loader) loadPath(path string, defaults Defaults) error {
+	l.config.Paths = append(l.config.Paths, path)
+	files, err := configurationFiles(path)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err = l.loadFile(file, defaults); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadFile loads a single configuration file and the ones it includes, which
+// are relative to it. Files are only loaded once, so include cycles are fine.
+// Its defaults override the inherited ones, and are inherited by its includes.
+func (l *loader) loadFile(filename string, inherited Defaults) error {
+	abs, err := filepath.Abs(filename)
+	if err != nil {
+		return fmt.Errorf("failed reading configuration file %s: %s", filename, err)
+	}
+	if l.loaded[abs] {
+		logrus.Debugf("configuration file %s is already loaded", filename)
+		return nil
+	}
+	l.loaded[abs] = true
+
+	logrus.Debugf("reading configuration file %s", filename)
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("failed reading configuration file %s: %s", filename, err)
+	}
+
+	c := Config{}
+	if err = yaml.Unmarshal(b, &c); err != nil {
+		return fmt.Errorf("failed to parse configuration file %s: %s", filename, err)
+	}
+	if err = c.Defaults.check(); err != nil {
+		return fmt.Errorf("invalid defaults in %s: %s", filename, err)
+	}
+	defaults := inherited.merge(c.Defaults)
+
+	// The configuration keeps the defaults of its first file, which are the
+	// ones written back when it is a single file
+	if len(l.config.Files) == 0 {
+		l.config.Defaults = c.Defaults
+	}
+	l.config.Files = append(l.config.Files, filename)
+
+	lines := repositoryLines(b, len(c.Repositories))
+	for i := range c.Repositories {
+		r := &c.Repositories[i]
+		r.File = filename
+		r.Line = lines[i]
+		if err = r.ParseWithDefaults(defaults); err != nil {
+			return err
+		}
+		if err = l.checkDuplicate(*r); err != nil {
+			return err
+		}
+		l.config.Repositories = append(l.config.Repositories, *r)
+	}
+
+	for _, include := range c.Include {
+		if !filepath.IsAbs(include) {
+			include = filepath.Join(filepath.Dir(filename), include)
+		}
+		if err = l.loadPath(include, defaults); err != nil {
+			return fmt.Errorf("failed to include %s from %s: %s", include, filename, err)
+		}
+	}
+	return nil
+}
+
+// checkDuplicate fails when the repository origin is already defined
+func (l *loader) checkDuplicate(r RepositoryConfig) error {
+	for _, existing := range l.config.Repositories {
+		if existing.OriginURL.ToKey() == r.OriginURL.ToKey() {
+			return fmt.Errorf("duplicate repository %s in %s, already defined in %s",
+				r.OriginURL.ToKey(), r.Source(), existing.Source())
+		}
+	}
+	return nil
+}
+
+// repositoryLines finds the line of every repository entry by the items of
+// the repositories sequence, in order, ignoring the nested sequences and the
+// origin keys of anything else, like credentials. The lines are left unknown,
+// as 0, when they can't be told.
+func repositoryLines(b []byte, repositories int) []int {
+	lines := make([]int, 0, repositories)
+	inRepositories, indent := false, -1
+	for i, line := range strings.Split(string(b), "\n") {
+		if comment := strings.Index(line, "#"); comment >= 0 {
+			line = line[:comment]
+		}
+		if key := topLevelKey.FindStringSubmatch(line); key != nil {
+			inRepositories, indent = key[1] == "repositories", -1
+			continue
+		}
+		item := sequenceItem.FindStringSubmatch(line)
+		if !inRepositories || item == nil {
+			continue
+		}
+		if indent < 0 {
+			indent = len(item[1])
+		}
+		if len(item[1]) == indent {
+			lines = append(lines, i+1)
+		}
+	}
+	if len(lines) != repositories {
+		return make([]int, repositories)
+	}
+	return lines
+}
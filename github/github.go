@@ -1,6 +1,7 @@
 package github
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -8,37 +9,70 @@ import (
 	"strings"
 
 	"github.com/sirupsen/logrus"
+	"gitlab.com/yakshaving.art/git-pull-mirror/httpclient"
 	giturl "gitlab.com/yakshaving.art/git-pull-mirror/url"
 )
 
 // Client is a GitHub client
 type Client struct {
-	opts ClientOpts
+	opts   ClientOpts
+	webURL string
 }
 
 // ClientOpts is used to store all the options
 type ClientOpts struct {
-	User        string
-	Token       string
+	User  string
+	Token string
+
+	// APIURL is the base of the REST API, like https://api.github.com or
+	// https://github.example.com/api/v3 for GitHub Enterprise Server. It is
+	// derived from GitHubURL when not set, and is DefaultAPIURL when neither is.
+	APIURL string
+	// GitHubURL is the hub endpoint used to register webhooks, it defaults
+	// to APIURL/hub when not set.
 	GitHubURL   string
 	CallbackURL string
+
+	// HTTPClient is the client used to talk to the API, a rate limited one is created if not set
+	HTTPClient *http.Client
 }
 
+// DefaultAPIURL is the api of github.com
+const DefaultAPIURL = "https://api.github.com"
+
 // New creates a new Client
 func New(opts ClientOpts) (Client, error) {
-	c := Client{opts}
+	c := Client{opts: opts}
 	if opts.User == "" {
 		return c, fmt.Errorf("GitHub username is necessary for registering webhooks")
 	}
 	if opts.Token == "" {
 		return c, fmt.Errorf("GitHub token is necessary for registering webhooks")
 	}
-	if opts.GitHubURL == "" {
-		return c, fmt.Errorf("GitHub url is necessary for registering webhooks")
+	switch {
+	case opts.APIURL != "":
+	case opts.GitHubURL != "":
+		c.opts.APIURL = strings.TrimSuffix(strings.TrimSuffix(opts.GitHubURL, "/"), "/hub")
+	default:
+		c.opts.APIURL = DefaultAPIURL
+	}
+	c.opts.APIURL = strings.TrimSuffix(c.opts.APIURL, "/")
+	if c.opts.GitHubURL == "" {
+		c.opts.GitHubURL = c.opts.APIURL + "/hub"
 	}
+
+	webURL, err := webURLFor(c.opts.APIURL)
+	if err != nil {
+		return c, fmt.Errorf("Invalid GitHub API url %s: %s", c.opts.APIURL, err)
+	}
+	c.webURL = webURL
+
 	if opts.CallbackURL == "" {
 		return c, fmt.Errorf("Callback url is necessary for registering webhooks")
 	}
+	if c.opts.HTTPClient == nil {
+		c.opts.HTTPClient = httpclient.New(httpclient.Opts{})
+	}
 	return c, nil
 }
 
@@ -51,47 +85,190 @@ func (c Client) GetCallbackURL() string {
 func (c Client) RegisterWebhook(uri giturl.GitURL) error {
 	logrus.Debugf("registering webhook for %s", uri)
 
-	form := url.Values{}
-	form.Add("hub.mode", "subscribe")
-	form.Add("hub.topic", fmt.Sprintf("https://%s/events/push", uri))
-	form.Add("hub.callback", c.opts.CallbackURL)
+	resp, err := c.hub("PATCH", "subscribe", uri)
+	if err != nil {
+		return fmt.Errorf("failed to patch webhook: %s", err)
+	}
 
-	do := func(method string) (*http.Response, error) {
-		req, err := http.NewRequest(method, c.opts.GitHubURL, strings.NewReader(form.Encode()))
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		resp, err = c.hub("POST", "subscribe", uri)
 		if err != nil {
-			return nil, fmt.Errorf("could not create request for webhook: %s", err)
+			return fmt.Errorf("failed to create new webhook: %s", err)
 		}
-		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-		req.SetBasicAuth(c.opts.User, c.opts.Token)
+	}
+	defer resp.Body.Close()
 
-		return http.DefaultClient.Do(req)
+	if err = checkResponse(resp); err != nil {
+		return fmt.Errorf("webhook creation request failed with %s", err)
 	}
 
-	resp, err := do("PATCH")
+	logrus.Debugf("webhook for %s correctly registered", uri)
+	return nil
+}
+
+// UnregisterWebhook removes the webhook that points to our callback url
+func (c Client) UnregisterWebhook(uri giturl.GitURL) error {
+	logrus.Debugf("unregistering webhook for %s", uri)
+
+	resp, err := c.hub("POST", "unsubscribe", uri)
 	if err != nil {
-		return fmt.Errorf("failed to patch webhook: %s", err)
+		return fmt.Errorf("failed to unsubscribe webhook: %s", err)
 	}
+	defer resp.Body.Close()
 
-	if resp.StatusCode == http.StatusNotFound {
-		resp, err = do("POST")
+	if err = checkResponse(resp); err != nil {
+		return fmt.Errorf("webhook removal request failed with %s", err)
+	}
+
+	logrus.Debugf("webhook for %s correctly unregistered", uri)
+	return nil
+}
+
+// ListWebhooks returns all the repositories that have a webhook pointing to
+// our callback url
+func (c Client) ListWebhooks() ([]giturl.GitURL, error) {
+	repos := make([]githubRepository, 0)
+	for page := 1; ; page++ {
+		r := make([]githubRepository, 0)
+		if err := c.get(fmt.Sprintf("/user/repos?per_page=%d&page=%d", pageSize, page), &r); err != nil {
+			return nil, fmt.Errorf("failed to list repositories: %s", err)
+		}
+		repos = append(repos, r...)
+		if len(r) < pageSize {
+			break
+		}
+	}
+
+	hooked := make([]giturl.GitURL, 0)
+	for _, repo := range repos {
+		if !repo.Permissions.Admin {
+			logrus.Debugf("skipping %s as we are not admins of it", repo.FullName)
+			continue
+		}
+
+		hooks, err := c.listHooks(repo.FullName)
 		if err != nil {
-			return fmt.Errorf("failed to create new webhook: %s", err)
+			return nil, err
+		}
+
+		for _, hook := range hooks {
+			if hook.Config.URL != c.opts.CallbackURL {
+				continue
+			}
+
+			u, err := giturl.Parse(repo.CloneURL)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse clone url %s for %s: %s", repo.CloneURL, repo.FullName, err)
+			}
+			hooked = append(hooked, u)
+			break
+		}
+	}
+
+	return hooked, nil
+}
+
+// listHooks returns all the webhooks of the repository, going through all the pages
+func (c Client) listHooks(fullName string) ([]githubHook, error) {
+	hooks := make([]githubHook, 0)
+	for page := 1; ; page++ {
+		h := make([]githubHook, 0)
+		if err := c.get(fmt.Sprintf("/repos/%s/hooks?per_page=%d&page=%d", fullName, pageSize, page), &h); err != nil {
+			return nil, fmt.Errorf("failed to list hooks for %s: %s", fullName, err)
+		}
+		hooks = append(hooks, h...)
+		if len(h) < pageSize {
+			return hooks, nil
 		}
 	}
+}
+
+const pageSize = 100
+
+type githubRepository struct {
+	FullName    string `json:"full_name"`
+	CloneURL    string `json:"clone_url"`
+	Permissions struct {
+		Admin bool `json:"admin"`
+	} `json:"permissions"`
+}
+
+type githubHook struct {
+	ID     int `json:"id"`
+	Config struct {
+		URL string `json:"url"`
+	} `json:"config"`
+}
+
+func (c Client) hub(method, mode string, uri giturl.GitURL) (*http.Response, error) {
+	form := url.Values{}
+	form.Add("hub.mode", mode)
+	form.Add("hub.topic", fmt.Sprintf("%s/%s/events/push", c.webURL, uri.ToKey()))
+	form.Add("hub.callback", c.opts.CallbackURL)
+
+	req, err := http.NewRequest(method, c.opts.GitHubURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("could not create request for webhook: %s", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(c.opts.User, c.opts.Token)
+
+	return c.opts.HTTPClient.Do(req)
+}
+
+func (c Client) get(path string, v interface{}) error {
+	req, err := http.NewRequest("GET", c.opts.APIURL+path, nil)
+	if err != nil {
+		return fmt.Errorf("could not create request: %s", err)
+	}
+	req.Header.Set("Accept", "application/vnd.github.v3+json")
+	req.SetBasicAuth(c.opts.User, c.opts.Token)
+
+	resp, err := c.opts.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err = checkResponse(resp); err != nil {
+		return fmt.Errorf("request failed with %s", err)
+	}
 
+	if err = json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed to decode response: %s", err)
+	}
+	return nil
+}
+
+// webURLFor returns the url in which the repositories are served for the
+// given api url: api.github.com for github.com and /api/v3 for GHES
+func webURLFor(apiURL string) (string, error) {
+	u, err := url.Parse(apiURL)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return "", fmt.Errorf("it should include schema and domain")
+	}
+
+	host := strings.TrimPrefix(u.Host, "api.")
+	path := strings.TrimSuffix(strings.TrimSuffix(u.Path, "/"), "/api/v3")
+
+	return fmt.Sprintf("%s://%s%s", u.Scheme, host, path), nil
+}
+
+func checkResponse(resp *http.Response) error {
 	switch resp.StatusCode {
 	case http.StatusOK, http.StatusCreated, http.StatusAccepted, http.StatusNoContent:
-		logrus.Debugf("webhook for %s correctly registered", uri)
 		return nil
 
 	default:
 		b, err := ioutil.ReadAll(resp.Body)
-		defer resp.Body.Close()
-
 		if err != nil {
-			return fmt.Errorf("webhook creation request failed with status %d %s - failed to read body: %s", resp.StatusCode, resp.Status, err)
+			return fmt.Errorf("status %d %s - failed to read body: %s", resp.StatusCode, resp.Status, err)
 		}
 
-		return fmt.Errorf("webhook creation request failed with status %d %s: %s", resp.StatusCode, resp.Status, string(b))
+		return fmt.Errorf("status %d %s: %s", resp.StatusCode, resp.Status, string(b))
 	}
 }
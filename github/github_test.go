@@ -1,10 +1,15 @@
 package github_test
 
 import (
+	"fmt"
 	"gitlab.com/yakshaving.art/git-pull-mirror/github"
 	"gitlab.com/yakshaving.art/git-pull-mirror/url"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -34,6 +39,7 @@ func TestRegisterNewWebhooks(t *testing.T) {
 
 	client, err := github.New(github.ClientOpts{
 		CallbackURL: "http://myhostname/mypath",
+		APIURL:      "https://api.mygithosing",
 		GitHubURL:   server.URL,
 		Token:       "mytoken",
 		User:        "myuser",
@@ -46,6 +52,129 @@ func TestRegisterNewWebhooks(t *testing.T) {
 	must(t, client.RegisterWebhook(u))
 }
 
+func TestUnregisterWebhooks(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertEquals(t, r.Method, "POST")
+		must(t, r.ParseForm())
+
+		assertEquals(t, r.FormValue("hub.mode"), "unsubscribe")
+		assertEquals(t, r.FormValue("hub.topic"), "https://mygithosing/mygroup/myproject/events/push")
+		assertEquals(t, r.FormValue("hub.callback"), "http://myhostname/mypath")
+
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	client, err := github.New(github.ClientOpts{
+		CallbackURL: "http://myhostname/mypath",
+		APIURL:      "https://api.mygithosing",
+		GitHubURL:   server.URL,
+		Token:       "mytoken",
+		User:        "myuser",
+	})
+	must(t, err)
+
+	u, _ := url.Parse("http://mygithosing/mygroup/myproject")
+	must(t, client.UnregisterWebhook(u))
+}
+
+func TestListWebhooks(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertEquals(t, r.Method, "GET")
+		switch r.URL.Path {
+		case "/user/repos":
+			fmt.Fprint(w, `[
+				{"full_name": "mygroup/hooked", "clone_url": "https://github.com/mygroup/hooked.git", "permissions": {"admin": true}},
+				{"full_name": "mygroup/other", "clone_url": "https://github.com/mygroup/other.git", "permissions": {"admin": true}},
+				{"full_name": "mygroup/readonly", "clone_url": "https://github.com/mygroup/readonly.git", "permissions": {"admin": false}}
+			]`)
+		case "/repos/mygroup/hooked/hooks":
+			// Our hook is in the second page
+			if r.URL.Query().Get("page") == "1" {
+				hooks := make([]string, 100)
+				for i := range hooks {
+					hooks[i] = fmt.Sprintf(`{"id": %d, "config": {"url": "http://otherhost/hooks"}}`, i+1)
+				}
+				fmt.Fprintf(w, "[%s]", strings.Join(hooks, ","))
+				return
+			}
+			assertEquals(t, "2", r.URL.Query().Get("page"))
+			fmt.Fprint(w, `[{"id": 101, "config": {"url": "http://myhostname/mypath"}}]`)
+		case "/repos/mygroup/other/hooks":
+			fmt.Fprint(w, `[{"id": 3, "config": {"url": "http://otherhost/hooks"}}]`)
+		default:
+			t.Fatalf("unexpected request to %s", r.URL.Path)
+		}
+	}))
+
+	client, err := github.New(github.ClientOpts{
+		CallbackURL: "http://myhostname/mypath",
+		GitHubURL:   server.URL + "/hub",
+		Token:       "mytoken",
+		User:        "myuser",
+	})
+	must(t, err)
+
+	hooked, err := client.ListWebhooks()
+	must(t, err)
+
+	if len(hooked) != 1 {
+		t.Fatalf("expected 1 hooked repository, got %d", len(hooked))
+	}
+	assertEquals(t, "mygroup/hooked", hooked[0].ToKey())
+}
+
+func TestRegisterWebhooksOnEnterpriseServer(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertEquals(t, r.URL.Path, "/api/v3/hub")
+		must(t, r.ParseForm())
+
+		assertEquals(t, r.FormValue("hub.topic"), server.URL+"/mygroup/myproject/events/push")
+	}))
+
+	client, err := github.New(github.ClientOpts{
+		CallbackURL: "http://myhostname/mypath",
+		APIURL:      server.URL + "/api/v3/",
+		Token:       "mytoken",
+		User:        "myuser",
+	})
+	must(t, err)
+
+	u, _ := url.Parse("http://mygithosing/mygroup/myproject")
+	must(t, client.RegisterWebhook(u))
+}
+
+func TestEnterpriseServerAPIIsDerivedFromTheHubURL(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v3/hub":
+			must(t, r.ParseForm())
+			assertEquals(t, server.URL+"/mygroup/myproject/events/push", r.FormValue("hub.topic"))
+		case "/api/v3/user/repos":
+			fmt.Fprint(w, `[]`)
+		default:
+			t.Fatalf("unexpected request to %s", r.URL.Path)
+		}
+	}))
+	defer server.Close()
+
+	client, err := github.New(github.ClientOpts{
+		CallbackURL: "http://myhostname/mypath",
+		GitHubURL:   server.URL + "/api/v3/hub",
+		Token:       "mytoken",
+		User:        "myuser",
+	})
+	must(t, err)
+
+	u, _ := url.Parse("http://mygithosing/mygroup/myproject")
+	must(t, client.RegisterWebhook(u))
+
+	_, err = client.ListWebhooks()
+	must(t, err)
+}
+
 func must(t *testing.T, err error) {
 	if err != nil {
 		t.Fatalf("Got error %s", err)
@@ -57,3 +186,33 @@ func assertEquals(t *testing.T, expected, actual string) {
 		t.Fatalf("%s != %s", expected, actual)
 	}
 }
+
+func TestHookRangesAreSavedAndLoaded(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertEquals(t, r.URL.Path, "/meta")
+		fmt.Fprint(w, `{"verifiable_password_authentication": true, "hooks": ["192.30.252.0/22", "140.82.112.0/20"]}`)
+	}))
+	defer server.Close()
+
+	client, err := github.New(github.ClientOpts{
+		CallbackURL: "http://myhostname/mypath",
+		APIURL:      server.URL,
+		Token:       "mytoken",
+		User:        "myuser",
+	})
+	must(t, err)
+
+	ranges, err := client.HookRanges()
+	must(t, err)
+	assertEquals(t, strings.Join(ranges, ","), "192.30.252.0/22,140.82.112.0/20")
+
+	dir, err := ioutil.TempDir("", "meta")
+	must(t, err)
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "meta.json")
+	must(t, github.SaveHookRanges(filename, ranges))
+	loaded, err := github.LoadHookRanges(filename)
+	must(t, err)
+	assertEquals(t, strings.Join(loaded, ","), "192.30.252.0/22,140.82.112.0/20")
+}
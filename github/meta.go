@@ -0,0 +1,71 @@
+package github
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// meta is the subset of the GitHub meta API response we care about
+type meta struct {
+	Hooks []string `json:"hooks"`
+}
+
+// HookRanges returns the CIDR ranges GitHub delivers webhooks from, as
+// published by the meta API
+func (c Client) HookRanges() ([]string, error) {
+	m := meta{}
+	if err := c.get("/meta", &m); err != nil {
+		return nil, fmt.Errorf("failed to get meta: %s", err)
+	}
+	if len(m.Hooks) == 0 {
+		return nil, fmt.Errorf("meta has no hook ranges")
+	}
+	return m.Hooks, nil
+}
+
+// LoadHookRanges reads the hook ranges from a meta API response saved to a file
+func LoadHookRanges(filename string) ([]string, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read meta file %s: %s", filename, err)
+	}
+
+	m := meta{}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("failed to parse meta file %s: %s", filename, err)
+	}
+	if len(m.Hooks) == 0 {
+		return nil, fmt.Errorf("meta file %s has no hook ranges", filename)
+	}
+	return m.Hooks, nil
+}
+
+// SaveHookRanges writes the hook ranges to a file in the meta API format,
+// replacing it atomically
+func SaveHookRanges(filename string, ranges []string) error {
+	b, err := json.MarshalIndent(meta{Hooks: ranges}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal meta: %s", err)
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename))
+	if err != nil {
+		return fmt.Errorf("failed to create meta file: %s", err)
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write meta file: %s", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write meta file: %s", err)
+	}
+	if err := os.Rename(f.Name(), filename); err != nil {
+		return fmt.Errorf("failed to replace meta file %s: %s", filename, err)
+	}
+	return nil
+}
@@ -0,0 +1,248 @@
+package httpclient
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gitlab.com/yakshaving.art/git-pull-mirror/metrics"
+)
+
+// Default values used when the options are not set
+const (
+	DefaultTimeout     = 30 * time.Second
+	DefaultConcurrency = 4
+	DefaultMaxWait     = 1 * time.Minute
+	DefaultMaxRetries  = 3
+)
+
+// Opts holds the http client options
+type Opts struct {
+	// Timeout is the timeout of every request, including the time spent waiting for rate limits
+	Timeout time.Duration
+	// Concurrency is the maximum number of in flight requests
+	Concurrency int
+	// MaxWait is the longest we will wait for a rate limit to reset before failing the request
+	MaxWait time.Duration
+	// MaxRetries is how many times a rate limited request will be retried,
+	// DefaultMaxRetries when nil and never when 0
+	MaxRetries *int
+	// TLSConfig is used to talk to APIs with custom certificate authorities or client certificates
+	TLSConfig *tls.Config
+	// Transport is the underlying round tripper, http.DefaultTransport by default
+	Transport http.RoundTripper
+}
+
+// New returns an http client that respects the rate limit headers returned
+// by the API, limits the number of requests in flight and times out
+func New(opts Opts) *http.Client {
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = DefaultConcurrency
+	}
+	if opts.MaxWait <= 0 {
+		opts.MaxWait = DefaultMaxWait
+	}
+	maxRetries := DefaultMaxRetries
+	if opts.MaxRetries != nil {
+		maxRetries = *opts.MaxRetries
+	}
+	if opts.Transport == nil && opts.TLSConfig != nil {
+		opts.Transport = &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			TLSClientConfig:     opts.TLSConfig,
+			TLSHandshakeTimeout: 10 * time.Second,
+			IdleConnTimeout:     90 * time.Second,
+			MaxIdleConns:        100,
+		}
+	}
+	if opts.Transport == nil {
+		opts.Transport = http.DefaultTransport
+	}
+
+	return &http.Client{
+		Timeout: opts.Timeout,
+		Transport: &rateLimitedTransport{
+			opts:       opts,
+			maxRetries: maxRetries,
+			inFlight:   make(chan interface{}, opts.Concurrency),
+			lock:       &sync.Mutex{},
+			blockedBy:  make(map[string]time.Time),
+		},
+	}
+}
+
+// LoadTLSConfig creates a TLS configuration that trusts the system roots and
+// the certificates in the CA file, and presents the client certificate if any
+func LoadTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+
+	if caFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file %s: %s", caFile, err)
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates could be parsed from CA file %s", caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate %s: %s", certFile, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+type rateLimitedTransport struct {
+	opts       Opts
+	maxRetries int
+	inFlight   chan interface{}
+
+	lock      *sync.Mutex
+	blockedBy map[string]time.Time
+}
+
+// RoundTrip implements http.RoundTripper, retries are sent as clones of the
+// request so the one from the caller is never modified
+func (t *rateLimitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+	current := req
+
+	for attempt := 0; ; attempt++ {
+		if err := t.waitForRateLimit(current); err != nil {
+			return nil, err
+		}
+
+		resp, err := t.do(current)
+		if err != nil {
+			metrics.APIRequestsTotal.WithLabelValues(host, "error").Inc()
+			return nil, err
+		}
+		metrics.APIRequestsTotal.WithLabelValues(host, strconv.Itoa(resp.StatusCode)).Inc()
+
+		wait, limited := t.checkRateLimit(host, resp)
+		if !limited {
+			return resp, nil
+		}
+		metrics.APIRateLimitedTotal.WithLabelValues(host).Inc()
+
+		if attempt >= t.maxRetries || wait > t.opts.MaxWait || !rewindable(req) {
+			return resp, nil
+		}
+
+		logrus.Warnf("request to %s was rate limited, retrying in %s", req.URL, wait)
+		discard(resp)
+
+		current = req.Clone(req.Context())
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, fmt.Errorf("failed to rewind request body: %s", err)
+			}
+			current.Body = body
+		}
+	}
+}
+
+func (t *rateLimitedTransport) do(req *http.Request) (*http.Response, error) {
+	select {
+	case t.inFlight <- true:
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+	defer func() { <-t.inFlight }()
+
+	return t.opts.Transport.RoundTrip(req)
+}
+
+// waitForRateLimit blocks until the rate limit for the host of the request is
+// reset, or fails if it would take longer than the maximum wait
+func (t *rateLimitedTransport) waitForRateLimit(req *http.Request) error {
+	t.lock.Lock()
+	until, ok := t.blockedBy[req.URL.Host]
+	t.lock.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	wait := time.Until(until)
+	if wait <= 0 {
+		return nil
+	}
+	if wait > t.opts.MaxWait {
+		return fmt.Errorf("rate limit for %s exhausted until %s", req.URL.Host, until.Format(time.RFC3339))
+	}
+
+	logrus.Debugf("rate limit for %s exhausted, waiting %s", req.URL.Host, wait)
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-req.Context().Done():
+		return req.Context().Err()
+	}
+}
+
+// checkRateLimit records the rate limit state returned by the API, and
+// returns how long to wait if the response was rate limited
+func (t *rateLimitedTransport) checkRateLimit(host string, resp *http.Response) (time.Duration, bool) {
+	var until time.Time
+
+	if remaining, err := strconv.Atoi(resp.Header.Get("X-RateLimit-Remaining")); err == nil {
+		metrics.APIRateLimitRemaining.WithLabelValues(host).Set(float64(remaining))
+
+		if reset, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64); err == nil && remaining == 0 {
+			until = time.Unix(reset, 0)
+		}
+	}
+
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+		until = time.Now().Add(time.Duration(seconds) * time.Second)
+	}
+
+	if !until.IsZero() {
+		t.lock.Lock()
+		t.blockedBy[host] = until
+		t.lock.Unlock()
+	}
+
+	switch resp.StatusCode {
+	case http.StatusForbidden, http.StatusTooManyRequests:
+		if until.IsZero() {
+			return 0, false
+		}
+		return time.Until(until), true
+	}
+	return 0, false
+}
+
+func rewindable(req *http.Request) bool {
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+func discard(resp *http.Response) {
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+}
@@ -0,0 +1,157 @@
+package httpclient_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gitlab.com/yakshaving.art/git-pull-mirror/httpclient"
+)
+
+func TestRetriesAfterBeingRateLimited(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.Header().Set("Retry-After", "0")
+			http.Error(w, "secondary rate limit", http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	client := httpclient.New(httpclient.Opts{})
+	resp, err := client.Post(server.URL, "text/plain", strings.NewReader("payload"))
+	must(t, err)
+
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected status %d, got %d", http.StatusNoContent, resp.StatusCode)
+	}
+	if calls != 2 {
+		t.Fatalf("expected 2 calls, got %d", calls)
+	}
+}
+
+func TestRetriesDoNotModifyTheRequest(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		must(t, err)
+		if string(body) != "payload" {
+			t.Errorf("expected the payload to be sent on every attempt, got %q", body)
+		}
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.Header().Set("Retry-After", "0")
+			http.Error(w, "secondary rate limit", http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	req, err := http.NewRequest(http.MethodPost, server.URL, strings.NewReader("payload"))
+	must(t, err)
+	body := req.Body
+
+	client := httpclient.New(httpclient.Opts{})
+	resp, err := client.Do(req)
+	must(t, err)
+	resp.Body.Close()
+
+	if calls != 2 {
+		t.Fatalf("expected 2 calls, got %d", calls)
+	}
+	if req.Body != body {
+		t.Fatalf("expected the body of the request to be left as it was")
+	}
+}
+
+func TestRetriesCanBeDisabled(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("Retry-After", "0")
+		http.Error(w, "secondary rate limit", http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	retries := 0
+	client := httpclient.New(httpclient.Opts{MaxRetries: &retries})
+	resp, err := client.Get(server.URL)
+	must(t, err)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected the rate limited response to be returned, got %d", resp.StatusCode)
+	}
+	if calls != 1 {
+		t.Fatalf("expected 1 call, got %d", calls)
+	}
+}
+
+func TestFailsWhenRateLimitResetIsTooFar(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-RateLimit-Remaining", "0")
+		w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10))
+		http.Error(w, "rate limit exceeded", http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	client := httpclient.New(httpclient.Opts{MaxWait: time.Second})
+	resp, err := client.Get(server.URL)
+	must(t, err)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected the rate limited response to be returned, got %d", resp.StatusCode)
+	}
+
+	if _, err = client.Get(server.URL); err == nil {
+		t.Fatalf("expected the following request to fail without reaching the server")
+	}
+}
+
+func TestLimitsRequestsInFlight(t *testing.T) {
+	var inFlight, maxInFlight int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+
+		for {
+			max := atomic.LoadInt32(&maxInFlight)
+			if current <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, current) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	client := httpclient.New(httpclient.Opts{Concurrency: 2})
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := client.Get(server.URL)
+			must(t, err)
+			resp.Body.Close()
+		}()
+	}
+	wg.Wait()
+
+	if maxInFlight > 2 {
+		t.Fatalf("expected at most 2 requests in flight, got %d", maxInFlight)
+	}
+}
+
+func must(t *testing.T, err error) {
+	if err != nil {
+		t.Fatalf("Got error %s", err)
+	}
+}
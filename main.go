@@ -1,26 +1,34 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
 	_ "gitlab.com/yakshaving.art/git-pull-mirror/metrics"
-	_ "net/http/pprof"
 
 	"github.com/onrik/logrus/filename"
 	"github.com/sirupsen/logrus"
 
+	"gitlab.com/yakshaving.art/git-pull-mirror/audit"
 	"gitlab.com/yakshaving.art/git-pull-mirror/config"
 	"gitlab.com/yakshaving.art/git-pull-mirror/github"
+	"gitlab.com/yakshaving.art/git-pull-mirror/httpclient"
 	"gitlab.com/yakshaving.art/git-pull-mirror/server"
 	"gitlab.com/yakshaving.art/git-pull-mirror/version"
 	"gitlab.com/yakshaving.art/git-pull-mirror/webhooks"
 )
 
+// exitShutdownTimeout is the exit code when the updates had to be cancelled
+// because they didn't finish before the shutdown timeout
+const exitShutdownTimeout = 3
+
 func main() {
 	setupLogger()
 
@@ -40,11 +48,30 @@ func main() {
 		os.Exit(1)
 	}
 
-	// Start pprof before anything else
-	go func() {
-		logrus.Infof("starting pprof listener on %s", args.PprofAddress)
-		logrus.Fatal(http.ListenAndServe(args.PprofAddress, nil))
-	}()
+	apiAccess := accessRules(server.AccessRules{}, server.RoleOperator, args.AdminToken, args.AdminOperatorCNs)
+	apiAccess = accessRules(apiAccess, server.RoleReadOnly, args.AdminReadOnlyToken, args.AdminReadOnlyCNs)
+	metricsAccess := accessRules(server.AccessRules{}, server.RoleReadOnly, args.MetricsToken, args.MetricsClientCNs)
+	dashboardAccess := accessRules(server.AccessRules{}, server.RoleReadOnly, args.DashboardToken, args.DashboardClientCNs)
+	pprofAccess := accessRules(server.AccessRules{}, server.RoleReadOnly, args.PprofToken, args.PprofClientCNs)
+
+	// Start pprof before anything else, unless the admin listener serves it
+	if args.PprofAddress != "" && args.AdminAddress == "" {
+		go func() {
+			logrus.Infof("starting pprof listener on %s", args.PprofAddress)
+			logrus.Fatal(http.ListenAndServe(args.PprofAddress, server.PprofMux(pprofAccess)))
+		}()
+	}
+
+	tlsConfig, certs, err := serverTLSConfig(args.TLSCert, args.TLSKey, args.TLSClientCA, tls.RequireAndVerifyClientCert)
+	if err != nil {
+		logrus.Fatalf("Failed to load TLS configuration: %s", err)
+	}
+	// Client certificates are optional in the admin listener so the endpoints
+	// protected with bearer tokens keep working
+	adminTLS, adminCerts, err := serverTLSConfig(args.AdminTLSCert, args.AdminTLSKey, args.AdminClientCA, tls.VerifyClientCertIfGiven)
+	if err != nil {
+		logrus.Fatalf("Failed to load admin TLS configuration: %s", err)
+	}
 
 	c, err := config.LoadConfiguration(args.ConfigFile)
 	if err != nil {
@@ -56,35 +83,102 @@ func main() {
 		logrus.Fatalf("Failed to create GitHub Webhooks client: %s", err)
 	}
 
+	if args.PruneHooks {
+		if err := pruneWebhooks(client, c, args.DryRun); err != nil {
+			logrus.Fatalf("Failed to prune webhooks: %s", err)
+		}
+		os.Exit(0)
+	}
+
 	if args.DryRun {
 		os.Exit(0)
 	}
 
+	auditLog, err := audit.New(args.AuditFile, audit.DefaultRecords)
+	if err != nil {
+		logrus.Fatalf("Failed to open audit log: %s", err)
+	}
+
+	allowlist, err := createAllowlist(args, client)
+	if err != nil {
+		logrus.Fatalf("Failed to create webhooks allowlist: %s", err)
+	}
+
 	s := server.New(client, server.WebHooksServerOptions{
 		GitTimeoutSeconds: args.TimeoutSeconds,
 		RepositoriesPath:  args.RepositoriesPath,
 		SSHPrivateKey:     args.SSHKey,
 		Concurrency:       args.Concurrency,
+		ConfigConcurrency: args.ConfigConcurrency,
+		StrictConfig:      args.ConfigStrict,
+
+		WebhooksVerifySeconds: args.WebhooksVerifySeconds,
+		PollIntervalSeconds:   args.PollIntervalSeconds,
+		ReconcileSchedule:     args.ReconcileSchedule,
+		Allowlist:             allowlist,
+		TLS:                   tlsConfig,
+		ReadTimeoutSeconds:    args.ReadTimeoutSeconds,
+		WriteTimeoutSeconds:   args.WriteTimeoutSeconds,
+		IdleTimeoutSeconds:    args.IdleTimeoutSeconds,
+		AuditLog:              auditLog,
+		AdminAddress:          args.AdminAddress,
+		AdminTLS:              adminTLS,
+		APIAccess:             apiAccess,
+		MetricsAccess:         metricsAccess,
+		DashboardAccess:       dashboardAccess,
+		PprofAccess:           pprofAccess,
+		ConfigFile:            args.ConfigFile,
+		WatchConfig:           args.ConfigWatch,
+		QueueFile:             args.QueueFile,
 	})
 
 	signalCh := make(chan os.Signal, 1)
-	signal.Notify(signalCh, syscall.SIGHUP, syscall.SIGINT, syscall.SIGUSR1, syscall.SIGUSR2)
+	signal.Notify(signalCh, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR1, syscall.SIGUSR2)
 
 	ready := make(chan interface{})
 	go s.Run(args.Address, c, ready)
 
-	<-ready
+	// Setting up the repositories can take long on the first boot, so stopping
+	// doesn't wait for it, there is nothing to drain yet
+booting:
+	for {
+		select {
+		case <-ready:
+			break booting
+
+		case sig := <-signalCh:
+			switch sig {
+			case syscall.SIGINT, syscall.SIGTERM:
+				logrus.Infof("Received %s while setting up the repositories, stopping", sig)
+				auditLog.Close()
+				os.Exit(0)
+
+			case syscall.SIGUSR1:
+				logrus.Info("toggling debug log level")
+				toggleDebugLogLevel()
+
+			default:
+				logrus.Warnf("Received %s while setting up the repositories, ignoring it", sig)
+			}
+		}
+	}
 
 	for sig := range signalCh {
 		switch sig {
 		case syscall.SIGHUP:
 			logrus.Info("Reloading the configuration")
-			c, err := config.LoadConfiguration(args.ConfigFile)
-			if err != nil {
-				logrus.Errorf("Failed to load configuration: %s", err)
-				continue
+			for _, c := range []*server.CertificateReloader{certs, adminCerts} {
+				if c == nil {
+					continue
+				}
+				if err := c.Reload(); err != nil {
+					logrus.Errorf("Failed to reload certificate, keeping the current one: %s", err)
+				}
+			}
+
+			if err := s.Reload(); err != nil {
+				logrus.Errorf("Failed to reload the configuration: %s", err)
 			}
-			s.Configure(c)
 
 		case syscall.SIGUSR1:
 			logrus.Info("toggling debug log level")
@@ -94,9 +188,14 @@ func main() {
 			logrus.Info("Received USR2, forcing an update in all the repositories")
 			s.UpdateAll()
 
-		case syscall.SIGINT:
-			logrus.Info("Shutting down gracefully")
-			s.Shutdown()
+		case syscall.SIGINT, syscall.SIGTERM:
+			logrus.Infof("Received %s, shutting down gracefully", sig)
+			err := s.Shutdown(time.Duration(args.ShutdownTimeoutSeconds) * time.Second)
+			auditLog.Close()
+			if err != nil {
+				logrus.Errorf("Failed to shut down gracefully: %s", err)
+				os.Exit(exitShutdownTimeout)
+			}
 			os.Exit(0)
 		}
 	}
@@ -114,28 +213,68 @@ func toggleDebugLogLevel() {
 func parseArgs() config.Arguments {
 	args := config.Arguments{}
 	flag.StringVar(&args.Address, "listen.address", ":9092", "address in which to listen for webhooks")
-	flag.StringVar(&args.ConfigFile, "config.file", "mirrors.yml", "configuration file")
+	flag.StringVar(&args.ConfigFile, "config.file", "mirrors.yml", "configuration file, directory whose *.yml files are merged or glob")
 	flag.StringVar(&args.CallbackURL, "callback.url", os.Getenv("CALLBACK_URL"), "callback url to report to github for webhooks, must include schema and domain")
 	flag.BoolVar(&args.Debug, "debug", false, "enable debugging log level")
 	flag.BoolVar(&args.DryRun, "dryrun", false, "execute configuration loading, don't actually do anything")
 	flag.StringVar(&args.GithubUser, "github.user", os.Getenv("GITHUB_USER"), "github username, used to configure the webhooks through the API")
 	flag.StringVar(&args.GithubToken, "github.token", os.Getenv("GITHUB_TOKEN"), "github token, used as the password to configure the webhooks through the API")
-	flag.StringVar(&args.GithubURL, "github.url", "https://api.github.com/hub", "github api url to register webhooks")
+	flag.StringVar(&args.GithubAPIURL, "github.api.url", "", "github api base url, https://<hostname>/api/v3 for GitHub Enterprise Server, derived from the hub url or https://api.github.com by default")
+	flag.StringVar(&args.GithubURL, "github.url", "", "github hub url to register webhooks, derived from the api url by default")
+	flag.StringVar(&args.GithubCAFile, "github.ca.file", "", "file with additional CA certificates to trust when talking to the github api")
+	flag.StringVar(&args.GithubClientCert, "github.client.cert", "", "client certificate to present to the github api")
+	flag.StringVar(&args.GithubClientKey, "github.client.key", "", "client certificate key to present to the github api")
+	flag.Uint64Var(&args.APITimeoutSeconds, "api.timeout.seconds", 30, "webhooks api requests timeout in seconds, including the time waiting for rate limits")
+	flag.IntVar(&args.APIConcurrency, "api.concurrency", 4, "how many requests to the webhooks api can be in flight at the same time")
 
 	// flag.StringVar(&args.GitlabUser, "gitlab.user", os.Getenv("GITLAB_USER"), "gitlab username, used to configure the webhooks through the API")
 	// flag.StringVar(&args.GitlabToken, "gitlab.token", os.Getenv("GITLAB_TOKEN"), "gitlab token, used as the password to configure the webhooks through the API")
 	// flag.StringVar(&args.GitlabURL, "gitlab.url", "", "gitlab api url to register webhooks")
 
-	flag.StringVar(&args.WebhooksTarget, "webhooks.target", "github", "used to define different kinds of webhooks clients, GitHub by default")
+	flag.StringVar(&args.WebhooksTarget, "webhooks.target", "github", "used to define different kinds of webhooks clients, GitHub by default, none to disable webhooks and only poll")
+	flag.Uint64Var(&args.PollIntervalSeconds, "poll.interval.seconds", 0, "default interval in seconds to poll the repositories for changes, 0 disables polling for the repositories without a poll_interval")
+	flag.Uint64Var(&args.WebhooksVerifySeconds, "webhooks.verify.seconds", 3600, "how often to register again the webhooks to verify they are in place, 0 disables it")
+	flag.StringVar(&args.ReconcileSchedule, "reconcile.schedule", "", "cron schedule in which to compare origin and target of every repository and update the ones that drifted, like '*/30 * * * *', disabled by default")
+	flag.StringVar(&args.WebhooksAllowCIDRs, "webhooks.allow.cidrs", "", "comma separated CIDR ranges webhooks are accepted from, they are accepted from anywhere unless some range is configured")
+	flag.StringVar(&args.GithubMetaFile, "webhooks.allow.github.meta.file", "", "GitHub meta api response file with the hook ranges webhooks are accepted from")
+	flag.Uint64Var(&args.GithubMetaRefreshSeconds, "webhooks.allow.github.meta.refresh.seconds", 0, "how often to refresh the hook ranges from the GitHub meta api, saving them to the meta file, 0 disables it")
+	flag.StringVar(&args.WebhooksTrustedProxies, "webhooks.trusted.proxies", "", "comma separated CIDR ranges of the proxies whose X-Forwarded-For header is trusted")
+	flag.Uint64Var(&args.ShutdownTimeoutSeconds, "shutdown.timeout.seconds", 60, "how long to wait for the queued and running updates to finish when shutting down before cancelling them")
+	flag.StringVar(&args.QueueFile, "shutdown.queue.file", "", "file in which to write the updates cancelled when shutting down, to run them on the next start")
+	flag.StringVar(&args.TLSCert, "tls.cert", "", "certificate to serve the webhooks listener with tls, it is reloaded on SIGHUP")
+	flag.StringVar(&args.TLSKey, "tls.key", "", "certificate key to serve the webhooks listener with tls")
+	flag.StringVar(&args.TLSClientCA, "tls.client.ca", "", "CA file to verify the client certificates, which are then required in the webhooks listener")
+	flag.Uint64Var(&args.ReadTimeoutSeconds, "http.read.timeout.seconds", 30, "how long the listeners wait to read a request, 0 disables it")
+	flag.Uint64Var(&args.WriteTimeoutSeconds, "http.write.timeout.seconds", 30, "how long the webhooks listener takes to write a response when the admin api is apart, 0 disables it")
+	flag.Uint64Var(&args.IdleTimeoutSeconds, "http.idle.timeout.seconds", 120, "how long the listeners keep idle connections open, 0 disables it")
+	flag.StringVar(&args.AdminAddress, "admin.address", "", "address in which to serve the metrics, pprof and the admin api, they are served in the listen address when not set")
+	flag.StringVar(&args.AdminTLSCert, "admin.tls.cert", "", "certificate to serve the admin listener with tls")
+	flag.StringVar(&args.AdminTLSKey, "admin.tls.key", "", "certificate key to serve the admin listener with tls")
+	flag.StringVar(&args.AdminClientCA, "admin.tls.client.ca", "", "CA file to verify the client certificates presented to the admin listener")
+	flag.StringVar(&args.AdminToken, "admin.token", os.Getenv("ADMIN_TOKEN"), "operator bearer token for the admin api, the endpoints that change state are disabled without operators")
+	flag.StringVar(&args.AdminReadOnlyToken, "admin.readonly.token", os.Getenv("ADMIN_READONLY_TOKEN"), "read only bearer token for the admin api")
+	flag.StringVar(&args.AdminOperatorCNs, "admin.operator.client.cns", "", "comma separated common names of the client certificates with the operator role in the admin api")
+	flag.StringVar(&args.AdminReadOnlyCNs, "admin.readonly.client.cns", "", "comma separated common names of the client certificates with the read only role in the admin api")
+	flag.StringVar(&args.MetricsToken, "metrics.token", os.Getenv("METRICS_TOKEN"), "bearer token required to read the metrics")
+	flag.StringVar(&args.MetricsClientCNs, "metrics.client.cns", "", "comma separated common names of the client certificates allowed to read the metrics")
+	flag.StringVar(&args.DashboardToken, "dashboard.token", os.Getenv("DASHBOARD_TOKEN"), "bearer token required to see the dashboard")
+	flag.StringVar(&args.DashboardClientCNs, "dashboard.client.cns", "", "comma separated common names of the client certificates allowed to see the dashboard")
+	flag.StringVar(&args.PprofToken, "pprof.token", os.Getenv("PPROF_TOKEN"), "bearer token required to access pprof")
+	flag.StringVar(&args.PprofClientCNs, "pprof.client.cns", "", "comma separated common names of the client certificates allowed to access pprof")
+	flag.StringVar(&args.AuditFile, "audit.file", "", "file in which to append a JSON line for every repository update, only the last ones are kept in memory when not set")
 	flag.StringVar(&args.RepositoriesPath, "repositories.path", ".", "local path in which to store cloned repositories")
 	flag.StringVar(&args.SSHKey, "sshkey", os.Getenv("SSH_KEY"), "ssh key to use to identify to remotes")
 	flag.Uint64Var(&args.TimeoutSeconds, "git.timeout.seconds", 60, "git operations timeout in seconds")
 
 	flag.BoolVar(&args.ShowVersion, "version", false, "print the version and exit")
+	flag.BoolVar(&args.PruneHooks, "prune-hooks", false, "remove the webhooks pointing to our callback url that have no matching configuration entry, then exit")
 
 	flag.IntVar(&args.Concurrency, "concurrency", 4, "how many background tasks to execute concurrently")
+	flag.IntVar(&args.ConfigConcurrency, "config.concurrency", 4, "how many repositories to clone or fetch concurrently when applying the configuration")
+	flag.BoolVar(&args.ConfigWatch, "config.watch", false, "reload the configuration file when it changes, as on SIGHUP")
+	flag.BoolVar(&args.ConfigStrict, "config.strict", false, "reject the whole configuration when any repository fails to be set up instead of retrying it in the background")
 
-	flag.StringVar(&args.PprofAddress, "pprof.address", "localhost:9093", "address in which to listen for pprof debugging requests")
+	flag.StringVar(&args.PprofAddress, "pprof.address", "localhost:9093", "address in which to listen for pprof debugging requests when there is no admin address, which serves pprof instead")
 
 	flag.Parse()
 
@@ -143,18 +282,155 @@ func parseArgs() config.Arguments {
 }
 
 func createClient(args config.Arguments) (webhooks.Client, error) {
-	// TODO: based on webhooksTarget we should create a github client or something else
+	if args.WebhooksTarget == config.NoWebhooksTarget {
+		return webhooks.NoopClient{}, nil
+	}
+
+	var tlsConfig *tls.Config
+	if args.GithubCAFile != "" || args.GithubClientCert != "" {
+		var err error
+		if tlsConfig, err = httpclient.LoadTLSConfig(args.GithubCAFile, args.GithubClientCert, args.GithubClientKey); err != nil {
+			return nil, err
+		}
+	}
+
 	return github.New(github.ClientOpts{
 		User:        args.GithubUser,
 		Token:       args.GithubToken,
+		APIURL:      args.GithubAPIURL,
 		GitHubURL:   args.GithubURL,
 		CallbackURL: args.CallbackURL,
+		HTTPClient: httpclient.New(httpclient.Opts{
+			Timeout:     time.Duration(args.APITimeoutSeconds) * time.Second,
+			Concurrency: args.APIConcurrency,
+			TLSConfig:   tlsConfig,
+		}),
 	})
 }
 
+// createAllowlist returns the allowlist of the webhooks sources, or none when
+// there are no ranges configured
+func createAllowlist(args config.Arguments, client webhooks.Client) (*server.Allowlist, error) {
+	opts := server.AllowlistOpts{
+		CIDRs:           splitList(args.WebhooksAllowCIDRs),
+		TrustedProxies:  splitList(args.WebhooksTrustedProxies),
+		RefreshInterval: time.Duration(args.GithubMetaRefreshSeconds) * time.Second,
+	}
+
+	gh, refresh := client.(github.Client)
+	refresh = refresh && args.GithubMetaRefreshSeconds > 0
+
+	if args.GithubMetaFile != "" {
+		ranges, err := github.LoadHookRanges(args.GithubMetaFile)
+		switch {
+		case err == nil:
+			opts.HookRanges = ranges
+		case refresh:
+			logrus.Warnf("%s, waiting for the meta api", err)
+		default:
+			return nil, err
+		}
+	}
+	if refresh {
+		opts.Refresh = func() ([]string, error) {
+			ranges, err := gh.HookRanges()
+			if err != nil {
+				return nil, err
+			}
+			if args.GithubMetaFile != "" {
+				if err := github.SaveHookRanges(args.GithubMetaFile, ranges); err != nil {
+					logrus.Warnf("failed to save hook ranges: %s", err)
+				}
+			}
+			return ranges, nil
+		}
+	}
+
+	if len(opts.CIDRs) == 0 && opts.HookRanges == nil && opts.Refresh == nil {
+		return nil, nil
+	}
+	return server.NewAllowlist(opts)
+}
+
+// pruneWebhooks unregisters all the webhooks that point to our callback url
+// for repositories that are not in the configuration
+func pruneWebhooks(client webhooks.Client, c config.Config, dryRun bool) error {
+	configured := make(map[string]bool, len(c.Repositories))
+	for _, r := range c.Repositories {
+		configured[r.OriginURL.ToKey()] = true
+	}
+
+	hooked, err := client.ListWebhooks()
+	if err != nil {
+		return err
+	}
+
+	for _, u := range hooked {
+		if configured[u.ToKey()] {
+			continue
+		}
+		if dryRun {
+			logrus.Infof("would prune webhook for %s", u)
+			continue
+		}
+
+		logrus.Infof("pruning webhook for %s", u)
+		if err := client.UnregisterWebhook(u); err != nil {
+			return fmt.Errorf("failed to unregister webhook for %s: %s", u, err)
+		}
+	}
+	return nil
+}
+
 func setupLogger() {
 	logrus.AddHook(filename.NewHook())
 	logrus.SetFormatter(&logrus.TextFormatter{
 		FullTimestamp: true,
 	})
 }
+
+// accessRules grants the role to the bearer token and to the comma separated
+// client certificate common names, if any
+func accessRules(rules server.AccessRules, role, token, cns string) server.AccessRules {
+	if rules.Tokens == nil {
+		rules.Tokens = make(map[string]string)
+		rules.ClientCNs = make(map[string]string)
+	}
+
+	if token != "" {
+		rules.Tokens[token] = role
+	}
+	for _, cn := range splitList(cns) {
+		rules.ClientCNs[cn] = role
+	}
+	return rules
+}
+
+// splitList splits a comma separated list, dropping the empty elements
+func splitList(list string) []string {
+	elements := make([]string, 0)
+	for _, e := range strings.Split(list, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			elements = append(elements, e)
+		}
+	}
+	return elements
+}
+
+// serverTLSConfig loads the certificate of a listener and the CA to verify
+// the client certificates, it returns no configuration when there is no certificate
+func serverTLSConfig(certFile, keyFile, clientCAFile string, clientAuth tls.ClientAuthType) (*tls.Config, *server.CertificateReloader, error) {
+	if certFile == "" {
+		return nil, nil, nil
+	}
+
+	certs, err := server.NewCertificateReloader(certFile, keyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	tlsConfig, err := server.TLSConfig(certs, clientCAFile, clientAuth)
+	if err != nil {
+		return nil, nil, err
+	}
+	return tlsConfig, certs, nil
+}
@@ -30,6 +30,12 @@ var (
 		Name:      "hooks_received_total",
 		Help:      "total number of hooks received",
 	})
+	HooksRejectedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "hooks_rejected_total",
+		Help:      "total number of hooks rejected, by reason",
+	}, []string{"reason"})
 	HooksRetriedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Namespace: namespace,
 		Subsystem: subsystem,
@@ -60,6 +66,78 @@ var (
 		Name:      "git_latency_seconds",
 		Help:      "latency of git operations",
 	}, []string{"operation", "repo"})
+	WebhookRegistered = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "webhook_registered",
+		Help:      "whether the webhook for a repo is registered or not",
+	}, []string{"repo"})
+	WebhookLastErrorTimestamp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "webhook_last_error_timestamp_seconds",
+		Help:      "unix timestamp of the last failed attempt to register the webhook of a repo",
+	}, []string{"repo"})
+	APIRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "api_requests_total",
+		Help:      "total number of requests sent to the webhooks api by status",
+	}, []string{"host", "status"})
+	APIRateLimitedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "api_rate_limited_total",
+		Help:      "total number of requests to the webhooks api that were rate limited",
+	}, []string{"host"})
+	APIRateLimitRemaining = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "api_rate_limit_remaining",
+		Help:      "number of requests remaining in the current rate limit window as reported by the webhooks api",
+	}, []string{"host"})
+	LastReconciled = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "last_reconciled_timestamp_seconds",
+		Help:      "unix timestamp of the last time a repo origin and target were compared",
+	}, []string{"repo"})
+	DriftDetectedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "drift_detected_total",
+		Help:      "total number of times a repo target was found out of sync with its origin",
+	}, []string{"repo"})
+	DivergentRefsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "divergent_refs_total",
+		Help:      "total number of branches in which the target had commits the origin doesn't, by the action taken",
+	}, []string{"repo", "action"})
+	UpstreamForcePushesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "upstream_force_pushes_total",
+		Help:      "total number of branches that were force pushed in origin",
+	}, []string{"repo"})
+	ReposConfigured = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "repos_configured",
+		Help:      "number of repositories set up successfully by the last configuration apply",
+	})
+	ReposPending = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "repos_pending",
+		Help:      "number of repositories waiting to be set up by the configuration apply in progress",
+	})
+	ConfigReloadTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "config_reload_total",
+		Help:      "total number of configuration reloads, by result",
+	}, []string{"result"})
 
 	bootTime = prometheus.NewGauge(prometheus.GaugeOpts{
 		Namespace: namespace,
@@ -82,14 +160,27 @@ func Register(path string, server *http.ServeMux) {
 
 	prometheus.MustRegister(bootTime)
 	prometheus.MustRegister(LastSuccessfulConfigApply)
+	prometheus.MustRegister(ReposConfigured)
+	prometheus.MustRegister(ReposPending)
+	prometheus.MustRegister(ConfigReloadTotal)
 	prometheus.MustRegister(HooksReceivedTotal)
 	prometheus.MustRegister(HooksAcceptedTotal)
+	prometheus.MustRegister(HooksRejectedTotal)
 	prometheus.MustRegister(HooksUpdatedTotal)
 	prometheus.MustRegister(HooksFailedTotal)
 	prometheus.MustRegister(GitLatencySecondsTotal)
 	prometheus.MustRegister(RepoIsUp)
 	prometheus.MustRegister(ServerIsUp)
 	prometheus.MustRegister(HooksRetriedTotal)
+	prometheus.MustRegister(WebhookRegistered)
+	prometheus.MustRegister(WebhookLastErrorTimestamp)
+	prometheus.MustRegister(APIRequestsTotal)
+	prometheus.MustRegister(APIRateLimitedTotal)
+	prometheus.MustRegister(APIRateLimitRemaining)
+	prometheus.MustRegister(LastReconciled)
+	prometheus.MustRegister(DriftDetectedTotal)
+	prometheus.MustRegister(DivergentRefsTotal)
+	prometheus.MustRegister(UpstreamForcePushesTotal)
 
 	server.Handle(path, prometheus.Handler())
 }
@@ -30,6 +30,18 @@ func TestMetricsAreRegistered(t *testing.T) {
 			"hooks accepted",
 			metrics.HooksAcceptedTotal,
 		},
+		{
+			"repos configured",
+			metrics.ReposConfigured,
+		},
+		{
+			"repos pending",
+			metrics.ReposPending,
+		},
+		{
+			"hooks rejected",
+			metrics.HooksRejectedTotal,
+		},
 		{
 			"hook retried",
 			metrics.HooksRetriedTotal,
@@ -46,10 +58,50 @@ func TestMetricsAreRegistered(t *testing.T) {
 			"hooks updated",
 			metrics.HooksUpdatedTotal,
 		},
+		{
+			"config reload",
+			metrics.ConfigReloadTotal,
+		},
 		{
 			"config apply",
 			metrics.LastSuccessfulConfigApply,
 		},
+		{
+			"webhook registered",
+			metrics.WebhookRegistered,
+		},
+		{
+			"webhook last error",
+			metrics.WebhookLastErrorTimestamp,
+		},
+		{
+			"api requests",
+			metrics.APIRequestsTotal,
+		},
+		{
+			"api rate limited",
+			metrics.APIRateLimitedTotal,
+		},
+		{
+			"api rate limit remaining",
+			metrics.APIRateLimitRemaining,
+		},
+		{
+			"last reconciled",
+			metrics.LastReconciled,
+		},
+		{
+			"drift detected",
+			metrics.DriftDetectedTotal,
+		},
+		{
+			"divergent refs",
+			metrics.DivergentRefsTotal,
+		},
+		{
+			"upstream force pushes",
+			metrics.UpstreamForcePushesTotal,
+		},
 	}
 	for _, tc := range tt {
 		t.Run(tc.name, func(t *testing.T) {
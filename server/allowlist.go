@@ -0,0 +1,190 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Reasons why a webhook delivery is rejected by the allowlist
+const (
+	rejectSourceNotAllowed = "source_not_allowed"
+	rejectInvalidSource    = "invalid_source"
+)
+
+// AllowlistOpts holds the options of the webhooks source allowlist
+type AllowlistOpts struct {
+	// CIDRs are the ranges webhooks are always accepted from
+	CIDRs []string
+	// TrustedProxies are the ranges of the proxies in front of us, the
+	// X-Forwarded-For header is only followed through them
+	TrustedProxies []string
+
+	// HookRanges are the ranges webhooks are delivered from, like the ones
+	// published by GitHub, they are replaced every time they are refreshed
+	HookRanges []string
+	// Refresh returns the current hook ranges, it is called every refresh interval
+	Refresh         func() ([]string, error)
+	RefreshInterval time.Duration
+}
+
+// Allowlist decides which source addresses can deliver webhooks
+type Allowlist struct {
+	opts           AllowlistOpts
+	cidrs          []*net.IPNet
+	trustedProxies []*net.IPNet
+
+	lock       *sync.RWMutex
+	hookRanges []*net.IPNet
+}
+
+// NewAllowlist parses the ranges of the options
+func NewAllowlist(opts AllowlistOpts) (*Allowlist, error) {
+	cidrs, err := parseCIDRs(opts.CIDRs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid allowed ranges: %s", err)
+	}
+	trustedProxies, err := parseCIDRs(opts.TrustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trusted proxies: %s", err)
+	}
+
+	a := &Allowlist{
+		opts:           opts,
+		cidrs:          cidrs,
+		trustedProxies: trustedProxies,
+		lock:           &sync.RWMutex{},
+	}
+	if err := a.setHookRanges(opts.HookRanges); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func contains(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *Allowlist) setHookRanges(ranges []string) error {
+	hookRanges, err := parseCIDRs(ranges)
+	if err != nil {
+		return fmt.Errorf("invalid hook ranges: %s", err)
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.hookRanges = hookRanges
+	return nil
+}
+
+// refresh replaces the hook ranges, the current ones are kept on failure
+func (a *Allowlist) refresh() {
+	ranges, err := a.opts.Refresh()
+	if err == nil {
+		err = a.setHookRanges(ranges)
+	}
+	if err != nil {
+		logrus.Warnf("failed to refresh webhooks hook ranges, keeping the current ones: %s", err)
+		return
+	}
+	logrus.Debugf("refreshed webhooks hook ranges, %d ranges allowed", len(ranges))
+}
+
+// refreshLoop refreshes the hook ranges every refresh interval until done is closed
+func (a *Allowlist) refreshLoop(done chan interface{}) {
+	if a.opts.Refresh == nil || a.opts.RefreshInterval <= 0 {
+		return
+	}
+
+	a.refresh()
+	ticker := time.NewTicker(a.opts.RefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			a.refresh()
+		case <-done:
+			return
+		}
+	}
+}
+
+// sourceIP returns the address of the client, following the X-Forwarded-For
+// header from right to left for as long as the hops are trusted proxies
+func (a *Allowlist) sourceIP(r *http.Request) (net.IP, error) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid remote address %s", r.RemoteAddr)
+	}
+
+	if !contains(a.trustedProxies, ip) {
+		return ip, nil
+	}
+
+	hops := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		ip = net.ParseIP(hop)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid forwarded address %s", hop)
+		}
+		if !contains(a.trustedProxies, ip) {
+			return ip, nil
+		}
+	}
+	return ip, nil
+}
+
+// check returns why the request is rejected, or an empty reason when it is allowed
+func (a *Allowlist) check(r *http.Request) (string, error) {
+	ip, err := a.sourceIP(r)
+	if err != nil {
+		return rejectInvalidSource, err
+	}
+	if contains(a.cidrs, ip) {
+		return "", nil
+	}
+
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	if contains(a.hookRanges, ip) {
+		return "", nil
+	}
+	return rejectSourceNotAllowed, fmt.Errorf("source %s is not allowed", ip)
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAllowlist(t *testing.T) {
+	allowlist, err := NewAllowlist(AllowlistOpts{
+		CIDRs:          []string{"10.0.0.0/8"},
+		TrustedProxies: []string{"192.168.0.0/16"},
+		HookRanges:     []string{"140.82.112.0/20"},
+	})
+	must(t, "failed to create allowlist", err)
+
+	tt := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		reason     string
+	}{
+		{"allowed range", "10.1.2.3:1234", nil, ""},
+		{"hook range", "140.82.112.5:1234", nil, ""},
+		{"not allowed", "203.0.113.1:1234", nil, rejectSourceNotAllowed},
+		{"forwarded from an untrusted address is ignored", "203.0.113.1:1234", []string{"10.1.2.3"}, rejectSourceNotAllowed},
+		{"forwarded through a trusted proxy", "192.168.1.1:1234", []string{"140.82.112.5"}, ""},
+		{"forwarded through a chain of trusted proxies", "192.168.1.1:1234", []string{"10.1.2.3, 192.168.2.2"}, ""},
+		{"spoofed hop before the first untrusted one", "192.168.1.1:1234", []string{"10.1.2.3, 203.0.113.1"}, rejectSourceNotAllowed},
+		{"multiple forwarded headers", "192.168.1.1:1234", []string{"203.0.113.1", "140.82.112.5"}, ""},
+		{"trusted proxy without forwarded header", "192.168.1.1:1234", nil, rejectSourceNotAllowed},
+		{"invalid forwarded address", "192.168.1.1:1234", []string{"nonsense"}, rejectInvalidSource},
+		{"invalid remote address", "nonsense", nil, rejectInvalidSource},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/", nil)
+			r.RemoteAddr = tc.remoteAddr
+			for _, f := range tc.forwarded {
+				r.Header.Add("X-Forwarded-For", f)
+			}
+
+			reason, _ := allowlist.check(r)
+			assertEquals(t, tc.reason, reason)
+		})
+	}
+}
+
+func TestRefreshingHookRanges(t *testing.T) {
+	calls := 0
+	allowlist, err := NewAllowlist(AllowlistOpts{
+		HookRanges: []string{"140.82.112.0/20"},
+		Refresh: func() ([]string, error) {
+			calls++
+			if calls > 1 {
+				return nil, fmt.Errorf("github is down")
+			}
+			return []string{"192.30.252.0/22"}, nil
+		},
+		RefreshInterval: time.Hour,
+	})
+	must(t, "failed to create allowlist", err)
+
+	check := func(remoteAddr, expected string) {
+		r := httptest.NewRequest("POST", "/", nil)
+		r.RemoteAddr = remoteAddr
+		reason, _ := allowlist.check(r)
+		assertEquals(t, expected, reason)
+	}
+
+	check("140.82.112.5:1234", "")
+	check("192.30.252.5:1234", rejectSourceNotAllowed)
+
+	allowlist.refresh()
+	check("140.82.112.5:1234", rejectSourceNotAllowed)
+	check("192.30.252.5:1234", "")
+
+	// Failed refreshes keep the current ranges
+	allowlist.refresh()
+	check("192.30.252.5:1234", "")
+}
+
+func TestRejectingWebhooksFromUnknownSources(t *testing.T) {
+	allowlist, err := NewAllowlist(AllowlistOpts{CIDRs: []string{"10.0.0.0/8"}})
+	must(t, "failed to create allowlist", err)
+
+	ws := New(newFakeWebhooksClient(0), WebHooksServerOptions{Concurrency: 1, Allowlist: allowlist})
+	ws.running = true
+	ws.ready = true
+
+	r := httptest.NewRequest("POST", "/hooks", nil)
+	r.RemoteAddr = "203.0.113.1:1234"
+	w := httptest.NewRecorder()
+	ws.WebHookHandler(w, r)
+	assertEquals(t, fmt.Sprintf("%d", http.StatusForbidden), fmt.Sprintf("%d", w.Code))
+}
@@ -0,0 +1,364 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pborman/uuid"
+	"github.com/sirupsen/logrus"
+	"gitlab.com/yakshaving.art/git-pull-mirror/audit"
+	"gitlab.com/yakshaving.art/git-pull-mirror/config"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// maxBodyBytes is the biggest request body the api will read
+const maxBodyBytes = 1 << 20
+
+// AuditHandler returns the last repository updates, newest first. They can be
+// filtered with the repo and request_id query arguments, and limited with limit.
+func (ws *WebHooksServer) AuditHandler(w http.ResponseWriter, r *http.Request) {
+	if !ws.checkReader(w, r) {
+		return
+	}
+
+	limit := 100
+	if l := r.URL.Query().Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 0 {
+			http.Error(w, fmt.Sprintf("invalid limit %s", l), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	records := ws.opts.AuditLog.Query(r.URL.Query().Get("repo"), r.URL.Query().Get("request_id"), limit)
+	writeJSON(w, http.StatusOK, records)
+}
+
+// ConfigHandler returns the status of the applied configuration and the result
+// of the last reload
+func (ws *WebHooksServer) ConfigHandler(w http.ResponseWriter, r *http.Request) {
+	if !ws.checkReader(w, r) {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, ws.configStatus())
+}
+
+// RepositoriesHandler returns the status of all the configured repositories
+func (ws *WebHooksServer) RepositoriesHandler(w http.ResponseWriter, r *http.Request) {
+	if !ws.checkReader(w, r) {
+		return
+	}
+
+	w.Header().Set("ETag", ws.ETag())
+	statuses := ws.status.list()
+	for i := range statuses {
+		statuses[i].Webhook = ws.webhookStatus(statuses[i].Key)
+	}
+	writeJSON(w, http.StatusOK, statuses)
+}
+
+// RepositoryHandler returns the status of a single repository, identified by
+// its owner/name key as in /api/v1/repos/owner/name, and triggers a sync,
+// pauses or resumes it when posting to /sync, /pause or /resume under it
+func (ws *WebHooksServer) RepositoryHandler(w http.ResponseWriter, r *http.Request) {
+	segments := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/repos/"), "/"), "/")
+	if len(segments) < 2 || len(segments) > 3 {
+		http.Error(w, fmt.Sprintf("unknown path %s, it should be /api/v1/repos/owner/name", r.URL.Path), http.StatusNotFound)
+		return
+	}
+
+	// Only a third segment is an action, so repositories can be named as them
+	key := strings.Join(segments[:2], "/")
+	if len(segments) == 3 {
+		switch segments[2] {
+		case "sync":
+			ws.syncRepository(w, r, key)
+		case "pause":
+			ws.pauseRepository(w, r, key, true)
+		case "resume":
+			ws.pauseRepository(w, r, key, false)
+		default:
+			http.Error(w, fmt.Sprintf("unknown action %s, it should be sync, pause or resume", segments[2]), http.StatusNotFound)
+		}
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		if !ws.checkReader(w, r) {
+			return
+		}
+	case "PUT":
+		ws.putRepository(w, r, key)
+		return
+	case "DELETE":
+		ws.deleteRepository(w, r, key)
+		return
+	default:
+		http.Error(w, "only GET, PUT and DELETE are allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("ETag", ws.ETag())
+	status, ok := ws.status.get(key)
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown repo %s", key), http.StatusNotFound)
+		return
+	}
+	status.Webhook = ws.webhookStatus(key)
+	writeJSON(w, http.StatusOK, status)
+}
+
+// SyncJob is a sync triggered through the api
+type SyncJob struct {
+	ID      string         `json:"id"`
+	Repos   []string       `json:"repos"`
+	Records []audit.Record `json:"records,omitempty"`
+}
+
+// SyncAllHandler triggers a sync of all the repositories
+func (ws *WebHooksServer) SyncAllHandler(w http.ResponseWriter, r *http.Request) {
+	if !ws.checkOperator(w, r, "POST") {
+		return
+	}
+
+	ws.lock.Lock()
+	repos := make([]Repository, 0, len(ws.repositories))
+	for _, repo := range ws.repositories {
+		repos = append(repos, repo)
+	}
+	ws.lock.Unlock()
+
+	ws.sync(w, r, repos)
+}
+
+func (ws *WebHooksServer) syncRepository(w http.ResponseWriter, r *http.Request, key string) {
+	if !ws.checkOperator(w, r, "POST") {
+		return
+	}
+
+	ws.lock.Lock()
+	repo, ok := ws.repositories[key]
+	ws.lock.Unlock()
+
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown repo %s", key), http.StatusNotFound)
+		return
+	}
+
+	ws.sync(w, r, []Repository{repo})
+}
+
+// sync enqueues an update of the repositories, waiting for them to finish
+// when requested with wait=true
+func (ws *WebHooksServer) sync(w http.ResponseWriter, r *http.Request, repos []Repository) {
+	if !ws.isReady() {
+		http.Error(w, "Server is not ready to receive requests", http.StatusServiceUnavailable)
+		return
+	}
+
+	job := SyncJob{
+		ID:    uuid.NewUUID().String(),
+		Repos: make([]string, 0, len(repos)),
+	}
+	logrus.Infof("sync %s of %d repositories requested from %s", job.ID, len(repos), r.RemoteAddr)
+
+	finished := &sync.WaitGroup{}
+	for _, repo := range repos {
+		if !ws.enqueue(pullTask{id: job.ID, source: audit.SourceAPI, repo: repo, finished: finished}) {
+			http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		job.Repos = append(job.Repos, repo.origin.ToKey())
+	}
+	sort.Strings(job.Repos)
+
+	if r.URL.Query().Get("wait") != "true" {
+		writeJSON(w, http.StatusAccepted, job)
+		return
+	}
+
+	done := make(chan interface{})
+	go func() {
+		finished.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-r.Context().Done():
+		logrus.Debugf("stopped waiting for sync %s: %s", job.ID, r.Context().Err())
+		return
+	}
+
+	job.Records = ws.opts.AuditLog.Query("", job.ID, 0)
+	writeJSON(w, http.StatusOK, job)
+}
+
+// putRepository adds or updates a repository with the configuration in the
+// request body, in the same yaml (or json) format as in the configuration file
+func (ws *WebHooksServer) putRepository(w http.ResponseWriter, r *http.Request, key string) {
+	if !ws.checkOperator(w, r, "PUT") || !ws.checkReady(w) {
+		return
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxBodyBytes))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to read body: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	repo := config.RepositoryConfig{}
+	if err = yaml.UnmarshalStrict(body, &repo); err != nil {
+		http.Error(w, fmt.Sprintf("failed to parse repository: %s", err), http.StatusBadRequest)
+		return
+	}
+	if err = repo.ParseWithDefaults(ws.configDefaults()); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if repo.OriginURL.ToKey() != key {
+		http.Error(w, fmt.Sprintf("origin %s doesn't match repo %s", repo.OriginURL, key), http.StatusUnprocessableEntity)
+		return
+	}
+
+	created, err := ws.PutRepository(repo, r.Header.Get("If-Match"))
+	switch err {
+	case nil:
+	case errConfigChanged:
+		http.Error(w, err.Error(), http.StatusPreconditionFailed)
+		return
+	case errSplitConfig:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	default:
+		logrus.Errorf("failed to put repository %s: %s", key, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	status, _ := ws.status.get(key)
+	status.Webhook = ws.webhookStatus(key)
+
+	w.Header().Set("ETag", ws.ETag())
+	if created {
+		writeJSON(w, http.StatusCreated, status)
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// deleteRepository removes a repository from the configuration
+func (ws *WebHooksServer) deleteRepository(w http.ResponseWriter, r *http.Request, key string) {
+	if !ws.checkOperator(w, r, "DELETE") || !ws.checkReady(w) {
+		return
+	}
+
+	switch err := ws.DeleteRepository(key, r.Header.Get("If-Match")); err {
+	case nil:
+	case errConfigChanged:
+		http.Error(w, err.Error(), http.StatusPreconditionFailed)
+		return
+	case errSplitConfig:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case errUnknownRepository:
+		http.Error(w, fmt.Sprintf("unknown repo %s", key), http.StatusNotFound)
+		return
+	default:
+		logrus.Errorf("failed to delete repository %s: %s", key, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("ETag", ws.ETag())
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// pauseRepository pauses or resumes a repository
+func (ws *WebHooksServer) pauseRepository(w http.ResponseWriter, r *http.Request, key string, paused bool) {
+	if !ws.checkOperator(w, r, "POST") || !ws.checkReady(w) {
+		return
+	}
+
+	switch err := ws.SetPaused(key, paused, r.Header.Get("If-Match")); err {
+	case nil:
+	case errConfigChanged:
+		http.Error(w, err.Error(), http.StatusPreconditionFailed)
+		return
+	case errSplitConfig:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case errUnknownRepository:
+		http.Error(w, fmt.Sprintf("unknown repo %s", key), http.StatusNotFound)
+		return
+	default:
+		logrus.Errorf("failed to pause or resume repository %s: %s", key, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	status, _ := ws.status.get(key)
+	status.Webhook = ws.webhookStatus(key)
+
+	w.Header().Set("ETag", ws.ETag())
+	writeJSON(w, http.StatusOK, status)
+}
+
+// checkReady fails the request when the configuration was not loaded, as
+// changing it would overwrite the configuration file with a partial one
+func (ws *WebHooksServer) checkReady(w http.ResponseWriter) bool {
+	if !ws.isReady() {
+		http.Error(w, "Server is not ready to receive requests", http.StatusServiceUnavailable)
+		return false
+	}
+	return true
+}
+
+// checkOperator only allows requests with the given method from operators
+func (ws *WebHooksServer) checkOperator(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		http.Error(w, fmt.Sprintf("only %s is allowed", method), http.StatusMethodNotAllowed)
+		return false
+	}
+	return checkAccess(w, r, ws.opts.APIAccess, RoleOperator)
+}
+
+// checkReader only allows GET requests from read only users or operators
+func (ws *WebHooksServer) checkReader(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != "GET" {
+		http.Error(w, "only GET is allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	return checkAccess(w, r, ws.opts.APIAccess, RoleReadOnly)
+}
+
+func (ws *WebHooksServer) webhookStatus(key string) *WebhookStatus {
+	status, ok := ws.webhooks.Status(key)
+	if !ok {
+		return nil
+	}
+	return &status
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		logrus.Errorf("failed to marshal api response: %s", err)
+		http.Error(w, "failed to marshal response", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(b)
+}
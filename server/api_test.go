@@ -0,0 +1,665 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gitlab.com/yakshaving.art/git-pull-mirror/audit"
+	"gitlab.com/yakshaving.art/git-pull-mirror/config"
+	"gitlab.com/yakshaving.art/git-pull-mirror/url"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+func newTestAPIServer(t *testing.T) (*WebHooksServer, url.GitURL, url.GitURL) {
+	ws := New(newFakeWebhooksClient(0), WebHooksServerOptions{Concurrency: 1})
+
+	first, err := url.Parse("https://github.com/owner/first.git")
+	must(t, "failed to parse first url", err)
+	second, err := url.Parse("https://github.com/owner/second.git")
+	must(t, "failed to parse second url", err)
+	target, err := url.Parse("git@gitlab.com:mirror/repo.git")
+	must(t, "failed to parse target url", err)
+
+	ws.status.configure(config.Config{
+		Repositories: []config.RepositoryConfig{
+			{OriginURL: second, TargetURL: target},
+			{OriginURL: first, TargetURL: target},
+		},
+	})
+	return ws, first, second
+}
+
+func TestRepositoriesStatus(t *testing.T) {
+	ws, first, second := newTestAPIServer(t)
+
+	ws.webhooks.Register(first)
+
+	ws.status.queued(first.ToKey())
+	ws.status.started(first.ToKey())
+	ws.status.fetched(first.ToKey(), map[plumbing.ReferenceName]plumbing.Hash{
+		"refs/heads/master": plumbing.ZeroHash,
+		"refs/heads/other":  plumbing.ZeroHash,
+		"refs/tags/v1":      plumbing.ZeroHash,
+	})
+	ws.status.queued(second.ToKey())
+	ws.status.failed(second.ToKey(), fmt.Errorf("target is down"))
+
+	var statuses []RepositoryStatus
+	getJSON(t, ws.RepositoriesHandler, "/api/v1/repos", http.StatusOK, &statuses)
+
+	if len(statuses) != 2 {
+		t.Fatalf("Expected 2 repositories, got %d", len(statuses))
+	}
+
+	tt := []struct {
+		name     string
+		status   RepositoryStatus
+		key      string
+		state    string
+		refs     RefCounts
+		err      string
+		hooked   bool
+		fetched  bool
+		hasError bool
+	}{
+		{"running", statuses[0], "owner/first", StateRunning, RefCounts{Branches: 2, Tags: 1}, "", true, true, false},
+		{"queued", statuses[1], "owner/second", StateQueued, RefCounts{}, "target is down", false, false, true},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			assertEquals(t, tc.key, tc.status.Key)
+			assertEquals(t, tc.state, tc.status.State)
+			assertEquals(t, "gitlab.com/mirror/repo", tc.status.Target)
+			assertEquals(t, fmt.Sprintf("%v", tc.refs), fmt.Sprintf("%v", tc.status.Refs))
+			assertEquals(t, tc.err, tc.status.LastError)
+			assertEquals(t, fmt.Sprintf("%t", tc.hooked), fmt.Sprintf("%t", tc.status.Webhook != nil && tc.status.Webhook.Registered))
+			assertEquals(t, fmt.Sprintf("%t", tc.fetched), fmt.Sprintf("%t", tc.status.LastFetch != nil))
+			assertEquals(t, fmt.Sprintf("%t", tc.hasError), fmt.Sprintf("%t", tc.status.LastErrorTime != nil))
+		})
+	}
+
+	ws.status.finished(first.ToKey())
+
+	var status RepositoryStatus
+	getJSON(t, ws.RepositoryHandler, "/api/v1/repos/owner/first", http.StatusOK, &status)
+	assertEquals(t, StateIdle, status.State)
+	assertEquals(t, "github.com/owner/first", status.Origin)
+
+	ws.status.pushed(second.ToKey())
+	getJSON(t, ws.RepositoryHandler, "/api/v1/repos/owner/second", http.StatusOK, &status)
+	assertEquals(t, "", status.LastError)
+	if status.LastErrorTime != nil {
+		t.Fatalf("Expected the last error to be cleared by a successful push, got one at %s", status.LastErrorTime)
+	}
+
+	getJSON(t, ws.RepositoryHandler, "/api/v1/repos/owner/unknown", http.StatusNotFound, nil)
+}
+
+func TestRepositoriesNamedAsActions(t *testing.T) {
+	ws, _, _ := newTestAPIServer(t)
+
+	repos := make([]config.RepositoryConfig, 0)
+	for _, name := range []string{"sync", "pause", "resume"} {
+		origin, err := url.Parse("https://github.com/foo/" + name + ".git")
+		must(t, "failed to parse origin url", err)
+		repos = append(repos, config.RepositoryConfig{OriginURL: origin, TargetURL: origin})
+	}
+	ws.status.configure(config.Config{Repositories: repos})
+
+	tt := []struct {
+		path   string
+		status int
+	}{
+		{"/api/v1/repos/foo/sync", http.StatusOK},
+		{"/api/v1/repos/foo/pause", http.StatusOK},
+		{"/api/v1/repos/foo/resume/", http.StatusOK},
+		{"/api/v1/repos/foo", http.StatusNotFound},
+		{"/api/v1/repos/foo/sync/rename", http.StatusNotFound},
+		{"/api/v1/repos/foo/sync/sync/sync", http.StatusNotFound},
+	}
+	for _, tc := range tt {
+		t.Run(tc.path, func(t *testing.T) {
+			var status RepositoryStatus
+			getJSON(t, ws.RepositoryHandler, tc.path, tc.status, &status)
+			if tc.status == http.StatusOK {
+				assertEquals(t, strings.Trim(strings.TrimPrefix(tc.path, "/api/v1/repos/"), "/"), status.Key)
+			}
+		})
+	}
+}
+
+func TestDashboard(t *testing.T) {
+	ws, first, second := newTestAPIServer(t)
+
+	ws.webhooks.Register(first)
+	ws.status.queued(first.ToKey())
+	ws.status.failed(second.ToKey(), fmt.Errorf("target <is> down"))
+
+	w := httptest.NewRecorder()
+	ws.DashboardHandler(w, httptest.NewRequest("GET", "/dashboard", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	for _, expected := range []string{
+		"github.com/owner/first",
+		"github.com/owner/second",
+		`<td class="queued">queued</td>`,
+		"registered",
+		"target &lt;is&gt; down",
+		`sync('owner\/first', this)`,
+	} {
+		if !strings.Contains(w.Body.String(), expected) {
+			t.Fatalf("Expected dashboard to contain %s, got %s", expected, w.Body.String())
+		}
+	}
+}
+
+func TestDashboardAccess(t *testing.T) {
+	ws, _, _ := newTestAPIServer(t)
+	ws.opts.APIAccess = AccessRules{Tokens: map[string]string{"operator": RoleOperator}}
+
+	get := func(token string) int {
+		r := httptest.NewRequest("GET", "/dashboard", nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		ws.DashboardHandler(w, r)
+		return w.Code
+	}
+
+	// Browsers don't send the admin api token when loading the page
+	assertEquals(t, "200", fmt.Sprintf("%d", get("")))
+
+	ws.opts.DashboardAccess = AccessRules{Tokens: map[string]string{"viewer": RoleReadOnly}}
+	assertEquals(t, "401", fmt.Sprintf("%d", get("")))
+	assertEquals(t, "401", fmt.Sprintf("%d", get("operator")))
+	assertEquals(t, "200", fmt.Sprintf("%d", get("viewer")))
+}
+
+func TestAuditRecordsAreQueried(t *testing.T) {
+	ws, _, _ := newTestAPIServer(t)
+
+	ws.opts.AuditLog.Write(audit.Record{RequestID: "1", Repo: "github.com/owner/first"})
+	ws.opts.AuditLog.Write(audit.Record{RequestID: "2", Repo: "github.com/owner/second"})
+	ws.opts.AuditLog.Write(audit.Record{RequestID: "3", Repo: "github.com/owner/first"})
+
+	tt := []struct {
+		name     string
+		path     string
+		status   int
+		expected []string
+	}{
+		{"all", "/api/v1/audit", http.StatusOK, []string{"3", "2", "1"}},
+		{"by repo", "/api/v1/audit?repo=owner/first", http.StatusOK, []string{"3", "1"}},
+		{"by repo path", "/api/v1/audit?repo=github.com/owner/first", http.StatusOK, []string{"3", "1"}},
+		{"limited", "/api/v1/audit?limit=1", http.StatusOK, []string{"3"}},
+		{"invalid limit", "/api/v1/audit?limit=many", http.StatusBadRequest, nil},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			var records []audit.Record
+			getJSON(t, ws.AuditHandler, tc.path, tc.status, &records)
+			if tc.expected == nil {
+				return
+			}
+
+			got := make([]string, 0)
+			for _, r := range records {
+				got = append(got, r.RequestID)
+			}
+			assertEquals(t, fmt.Sprintf("%v", tc.expected), fmt.Sprintf("%v", got))
+		})
+	}
+}
+
+func TestSyncingThroughTheAPI(t *testing.T) {
+	_, dir := newTestGitClient(t)
+	defer os.RemoveAll(dir)
+
+	origin := newTestRepo(t, dir, "origin", "repo")
+	origin.commit(t, "README", "first")
+	target := newBareTestRepo(t, dir, "target", "repo")
+
+	ws := New(newFakeWebhooksClient(0), WebHooksServerOptions{
+		GitTimeoutSeconds: 10,
+		RepositoriesPath:  filepath.Join(dir, "local"),
+		Concurrency:       1,
+		APIAccess:         AccessRules{Tokens: map[string]string{"secret": RoleOperator}},
+	})
+	must(t, "failed to configure", ws.Configure(config.Config{
+		Repositories: []config.RepositoryConfig{{OriginURL: origin.url, TargetURL: target.url}},
+	}))
+
+	ws.running = true
+	go func() {
+		for task := range ws.tasksCh {
+			ws.updateRepository(task)
+		}
+	}()
+	defer ws.Shutdown(time.Minute)
+
+	head := origin.commit(t, "README", "second")
+
+	tt := []struct {
+		name    string
+		method  string
+		path    string
+		token   string
+		status  int
+		records int
+	}{
+		{"without a token", "POST", "/api/v1/repos/origin/repo/sync", "", http.StatusUnauthorized, 0},
+		{"with an invalid token", "POST", "/api/v1/repos/origin/repo/sync", "Bearer guessed", http.StatusUnauthorized, 0},
+		{"with GET", "GET", "/api/v1/repos/origin/repo/sync", "Bearer secret", http.StatusMethodNotAllowed, 0},
+		{"an unknown repo", "POST", "/api/v1/repos/origin/unknown/sync", "Bearer secret", http.StatusNotFound, 0},
+		{"a repo waiting", "POST", "/api/v1/repos/origin/repo/sync?wait=true", "Bearer secret", http.StatusOK, 1},
+		{"all repos waiting", "POST", "/api/v1/sync?wait=true", "Bearer secret", http.StatusOK, 1},
+		{"all repos without waiting", "POST", "/api/v1/sync", "Bearer secret", http.StatusAccepted, 0},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			handler := ws.RepositoryHandler
+			if tc.path == "/api/v1/sync" || tc.path == "/api/v1/sync?wait=true" {
+				handler = ws.SyncAllHandler
+			}
+
+			req := httptest.NewRequest(tc.method, tc.path, nil)
+			req.Header.Set("Authorization", tc.token)
+			w := httptest.NewRecorder()
+			handler(w, req)
+
+			if w.Code != tc.status {
+				t.Fatalf("Expected status %d, got %d: %s", tc.status, w.Code, w.Body.String())
+			}
+			if w.Code >= 300 {
+				return
+			}
+
+			var job SyncJob
+			must(t, "failed to parse response", json.Unmarshal(w.Body.Bytes(), &job))
+			assertEquals(t, "[origin/repo]", fmt.Sprintf("%v", job.Repos))
+			if len(job.Records) != tc.records {
+				t.Fatalf("Expected %d records, got %d", tc.records, len(job.Records))
+			}
+			for _, r := range job.Records {
+				assertEquals(t, job.ID, r.RequestID)
+				assertEquals(t, audit.SourceAPI, r.Source)
+				assertEquals(t, "", r.Error)
+			}
+		})
+	}
+
+	if h := target.head(t, "master"); h != head {
+		t.Fatalf("sync should have pushed %s to target, got %s", head, h)
+	}
+}
+
+func TestChangingRepositoriesThroughTheAPI(t *testing.T) {
+	_, dir := newTestGitClient(t)
+	defer os.RemoveAll(dir)
+
+	origin := newTestRepo(t, dir, "origin", "repo")
+	origin.commit(t, "README", "first")
+	other := newTestRepo(t, dir, "origin", "other")
+	other.commit(t, "README", "first")
+	target := newBareTestRepo(t, dir, "target", "repo")
+
+	configFile := filepath.Join(dir, "mirrors.yml")
+	ws := New(newFakeWebhooksClient(0), WebHooksServerOptions{
+		GitTimeoutSeconds: 10,
+		RepositoriesPath:  filepath.Join(dir, "local"),
+		Concurrency:       1,
+		APIAccess:         AccessRules{Tokens: map[string]string{"secret": RoleOperator}},
+		ConfigFile:        configFile,
+	})
+	must(t, "failed to configure", ws.Configure(config.Config{
+		Repositories: []config.RepositoryConfig{
+			{Origin: "https://github.com/origin/repo", OriginURL: origin.url, Target: "git@gitlab.com:target/repo.git", TargetURL: target.url},
+		},
+	}))
+	etag := ws.ETag()
+
+	// Local file urls can't be parsed from the configuration, so they are put directly
+	created, err := ws.PutRepository(config.RepositoryConfig{
+		Origin: "https://github.com/origin/other", OriginURL: other.url, Target: "git@gitlab.com:target/other.git", TargetURL: target.url,
+	}, etag)
+	must(t, "failed to put repository", err)
+	if !created {
+		t.Fatalf("repository should have been created")
+	}
+	if _, ok := ws.status.get("origin/other"); !ok {
+		t.Fatalf("put repository should be tracked")
+	}
+	if _, err = ws.PutRepository(config.RepositoryConfig{OriginURL: other.url, TargetURL: target.url}, etag); err != errConfigChanged {
+		t.Fatalf("putting with a stale etag should have failed, got %v", err)
+	}
+
+	b, err := ioutil.ReadFile(configFile)
+	must(t, "failed to read written configuration", err)
+	assertEquals(t, `---
+repositories:
+- origin: https://github.com/origin/repo
+  target: git@gitlab.com:target/repo.git
+- origin: https://github.com/origin/other
+  target: git@gitlab.com:target/other.git
+`, string(b))
+
+	tt := []struct {
+		name    string
+		method  string
+		path    string
+		ifMatch string
+		body    string
+		status  int
+	}{
+		{"put without a body", "PUT", "/api/v1/repos/origin/new", "", "", http.StatusUnprocessableEntity},
+		{"put an unknown field", "PUT", "/api/v1/repos/origin/new", "", "origin: https://github.com/origin/new\nbranch: master", http.StatusBadRequest},
+		{"put an invalid policy", "PUT", "/api/v1/repos/origin/new", "", `{"origin": "https://github.com/origin/new", "target": "git@gitlab.com:target/new.git", "on_divergence": "maybe"}`, http.StatusUnprocessableEntity},
+		{"put in another key", "PUT", "/api/v1/repos/origin/new", "", `{"origin": "https://github.com/origin/other", "target": "git@gitlab.com:target/new.git"}`, http.StatusUnprocessableEntity},
+		{"put with a stale etag", "PUT", "/api/v1/repos/origin/new", etag, `{"origin": "https://github.com/origin/new", "target": "git@gitlab.com:target/new.git"}`, http.StatusPreconditionFailed},
+		{"delete an unknown repo", "DELETE", "/api/v1/repos/origin/unknown", "", "", http.StatusNotFound},
+		{"delete with a stale etag", "DELETE", "/api/v1/repos/origin/other", etag, "", http.StatusPreconditionFailed},
+		{"delete", "DELETE", "/api/v1/repos/origin/other", ws.ETag(), "", http.StatusNoContent},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body))
+			req.Header.Set("Authorization", "Bearer secret")
+			if tc.ifMatch != "" {
+				req.Header.Set("If-Match", tc.ifMatch)
+			}
+			w := httptest.NewRecorder()
+			ws.RepositoryHandler(w, req)
+
+			if w.Code != tc.status {
+				t.Fatalf("Expected status %d, got %d: %s", tc.status, w.Code, w.Body.String())
+			}
+		})
+	}
+
+	if _, ok := ws.status.get("origin/other"); ok {
+		t.Fatalf("deleted repository should not be tracked")
+	}
+	if ws.WebHooksClient.(*fakeWebhooksClient).unregistered["origin/other"] != 1 {
+		t.Fatalf("deleted repository webhook should have been unregistered")
+	}
+
+	c, err := config.LoadConfiguration(configFile)
+	must(t, "failed to load written configuration", err)
+	if len(c.Repositories) != 1 || c.Repositories[0].Origin != "https://github.com/origin/repo" {
+		t.Fatalf("Unexpected written configuration %#v", c)
+	}
+
+	// A repository that can't be written to the configuration is not left behind
+	ws.opts.ConfigFile = filepath.Join(dir, "missing", "mirrors.yml")
+	if _, err = ws.PutRepository(config.RepositoryConfig{OriginURL: other.url, TargetURL: target.url}, ""); err == nil {
+		t.Fatalf("putting a repository that can't be written should have failed")
+	}
+	ws.opts.ConfigFile = configFile
+	if _, ok := ws.status.get("origin/other"); ok {
+		t.Fatalf("repository that failed to be written should not be tracked")
+	}
+	if ws.WebHooksClient.(*fakeWebhooksClient).unregistered["origin/other"] != 2 {
+		t.Fatalf("webhook of the repository that failed to be written should have been unregistered")
+	}
+	if _, err = os.Stat(filepath.Join(dir, "local", other.url.ToPath())); !os.IsNotExist(err) {
+		t.Fatalf("clone of the repository that failed to be written should have been removed, got %v", err)
+	}
+	// A configuration split in several files has to be changed in the files
+	ws.lock.Lock()
+	ws.config.Files = []string{configFile, filepath.Join(dir, "teams.yml")}
+	ws.lock.Unlock()
+
+	req := httptest.NewRequest("DELETE", "/api/v1/repos/origin/repo", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	ws.RepositoryHandler(w, req)
+	if w.Code != http.StatusConflict {
+		t.Fatalf("Expected status %d changing a split configuration, got %d: %s", http.StatusConflict, w.Code, w.Body.String())
+	}
+}
+
+func TestPausingRepositories(t *testing.T) {
+	_, dir := newTestGitClient(t)
+	defer os.RemoveAll(dir)
+
+	origin := newTestRepo(t, dir, "origin", "repo")
+	origin.commit(t, "README", "first")
+	target := newBareTestRepo(t, dir, "target", "repo")
+
+	ws := New(newFakeWebhooksClient(0), WebHooksServerOptions{
+		GitTimeoutSeconds: 10,
+		RepositoriesPath:  filepath.Join(dir, "local"),
+		Concurrency:       1,
+		APIAccess:         AccessRules{Tokens: map[string]string{"secret": RoleOperator}},
+	})
+	must(t, "failed to configure", ws.Configure(config.Config{
+		Repositories: []config.RepositoryConfig{{OriginURL: origin.url, TargetURL: target.url}},
+	}))
+
+	ws.running = true
+	go func() {
+		for task := range ws.tasksCh {
+			ws.updateRepository(task)
+		}
+	}()
+	defer ws.Shutdown(time.Minute)
+
+	post := func(path string, v interface{}) {
+		req := httptest.NewRequest("POST", path, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		ws.RepositoryHandler(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200 for %s, got %d: %s", path, w.Code, w.Body.String())
+		}
+		must(t, "failed to parse response", json.Unmarshal(w.Body.Bytes(), v))
+	}
+
+	var status RepositoryStatus
+	post("/api/v1/repos/origin/repo/pause", &status)
+	assertEquals(t, StatePaused, status.State)
+
+	head := origin.commit(t, "README", "second")
+
+	var job SyncJob
+	post("/api/v1/repos/origin/repo/sync?wait=true", &job)
+	if len(job.Records) != 1 || !job.Records[0].Paused {
+		t.Fatalf("Expected a single paused record, got %#v", job.Records)
+	}
+	if _, err := target.repo.Reference("refs/heads/master", false); err == nil {
+		t.Fatalf("paused repository should not have been pushed")
+	}
+
+	status, _ = ws.status.get("origin/repo")
+	if status.Pending != 1 {
+		t.Fatalf("Expected 1 pending update, got %d", status.Pending)
+	}
+
+	post("/api/v1/repos/origin/repo/resume", &status)
+	ws.wg.Wait()
+
+	if h := target.head(t, "master"); h != head {
+		t.Fatalf("resuming should have pushed %s to target, got %s", head, h)
+	}
+	records := ws.opts.AuditLog.Query("origin/repo", "", 1)
+	assertEquals(t, audit.SourceResume, records[0].Source)
+
+	status, _ = ws.status.get("origin/repo")
+	assertEquals(t, StateIdle, status.State)
+	if status.Pending != 0 {
+		t.Fatalf("Expected no pending updates after resuming, got %d", status.Pending)
+	}
+}
+
+func TestHealthChecks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "health_test")
+	must(t, "could not create a temporary dir", err)
+	defer os.RemoveAll(dir)
+
+	tt := []struct {
+		name    string
+		setup   func(ws *WebHooksServer)
+		handler func(ws *WebHooksServer) http.HandlerFunc
+		status  int
+		failing string
+	}{
+		{
+			"alive",
+			func(ws *WebHooksServer) {},
+			func(ws *WebHooksServer) http.HandlerFunc { return ws.HealthzHandler },
+			http.StatusOK, "",
+		},
+		{
+			"wedged worker",
+			func(ws *WebHooksServer) {
+				ws.workers.busySince[0] = time.Now().Add(-1 * time.Hour)
+			},
+			func(ws *WebHooksServer) http.HandlerFunc { return ws.HealthzHandler },
+			http.StatusServiceUnavailable, "workers",
+		},
+		{
+			"ready",
+			func(ws *WebHooksServer) {},
+			func(ws *WebHooksServer) http.HandlerFunc { return ws.ReadyzHandler },
+			http.StatusOK, "",
+		},
+		{
+			"not configured",
+			func(ws *WebHooksServer) {
+				ws.ready = false
+			},
+			func(ws *WebHooksServer) http.HandlerFunc { return ws.ReadyzHandler },
+			http.StatusServiceUnavailable, "configuration",
+		},
+		{
+			"full queue",
+			func(ws *WebHooksServer) {
+				ws.tasksCh <- pullTask{}
+			},
+			func(ws *WebHooksServer) http.HandlerFunc { return ws.ReadyzHandler },
+			http.StatusOK, "",
+		},
+		{
+			"saturated queue",
+			func(ws *WebHooksServer) {
+				ws.tasksCh <- pullTask{}
+				ws.blocked = 1
+			},
+			func(ws *WebHooksServer) http.HandlerFunc { return ws.ReadyzHandler },
+			http.StatusServiceUnavailable, "queue",
+		},
+		{
+			"not writable repositories path",
+			func(ws *WebHooksServer) {
+				ws.opts.RepositoriesPath = filepath.Join(dir, "non-existing")
+			},
+			func(ws *WebHooksServer) http.HandlerFunc { return ws.ReadyzHandler },
+			http.StatusServiceUnavailable, "repositories_path",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ws := New(newFakeWebhooksClient(0), WebHooksServerOptions{
+				GitTimeoutSeconds: 10,
+				RepositoriesPath:  dir,
+				Concurrency:       1,
+			})
+			ws.running = true
+			ws.ready = true
+			tc.setup(ws)
+
+			w := httptest.NewRecorder()
+			tc.handler(ws)(w, httptest.NewRequest("GET", "/", nil))
+			if w.Code != tc.status {
+				t.Fatalf("Expected status %d, got %d: %s", tc.status, w.Code, w.Body.String())
+			}
+
+			var health HealthStatus
+			must(t, "failed to parse response", json.Unmarshal(w.Body.Bytes(), &health))
+			for name, check := range health.Checks {
+				if check.OK == (name == tc.failing) {
+					t.Fatalf("Unexpected result of check %s: %#v", name, check)
+				}
+			}
+		})
+	}
+}
+
+func getJSON(t *testing.T, handler http.HandlerFunc, path string, status int, v interface{}) {
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", path, nil))
+
+	if w.Code != status {
+		t.Fatalf("Expected status %d for %s, got %d: %s", status, path, w.Code, w.Body.String())
+	}
+	if v == nil || status != http.StatusOK {
+		return
+	}
+	must(t, "failed to parse response", json.Unmarshal(w.Body.Bytes(), v))
+}
+
+func assertEquals(t *testing.T, expected, got string) {
+	if expected != got {
+		t.Fatalf("Expected %s, got %s", expected, got)
+	}
+}
+
+func TestAccessRules(t *testing.T) {
+	rules := AccessRules{
+		Tokens: map[string]string{
+			"operator": RoleOperator,
+			"reader":   RoleReadOnly,
+		},
+		ClientCNs: map[string]string{},
+	}
+
+	tt := []struct {
+		name     string
+		rules    AccessRules
+		token    string
+		required string
+		expected int
+	}{
+		{"open reads", AccessRules{}, "", RoleReadOnly, http.StatusOK},
+		{"operations are disabled without rules", AccessRules{}, "operator", RoleOperator, http.StatusForbidden},
+		{"missing token", rules, "", RoleReadOnly, http.StatusUnauthorized},
+		{"invalid token", rules, "invalid", RoleReadOnly, http.StatusUnauthorized},
+		{"reader reads", rules, "reader", RoleReadOnly, http.StatusOK},
+		{"reader operates", rules, "reader", RoleOperator, http.StatusForbidden},
+		{"operator reads", rules, "operator", RoleReadOnly, http.StatusOK},
+		{"operator operates", rules, "operator", RoleOperator, http.StatusOK},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			h := withAccess(tc.rules, tc.required, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}))
+
+			r := httptest.NewRequest("GET", "/metrics", nil)
+			if tc.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tc.token)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			assertEquals(t, fmt.Sprintf("%d", tc.expected), fmt.Sprintf("%d", w.Code))
+		})
+	}
+}
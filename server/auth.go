@@ -0,0 +1,101 @@
+package server
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+)
+
+// Roles of the admin api, operators can do everything read only users can
+const (
+	RoleReadOnly = "readonly"
+	RoleOperator = "operator"
+)
+
+// AccessRules define who can access a group of endpoints and with which role,
+// either presenting a bearer token or a client certificate verified by the
+// listener. A group without rules is open to anyone as read only.
+type AccessRules struct {
+	// Tokens maps bearer tokens to their role
+	Tokens map[string]string
+	// ClientCNs maps the common names of verified client certificates to their role
+	ClientCNs map[string]string
+}
+
+func (a AccessRules) enabled() bool {
+	return len(a.Tokens) > 0 || len(a.ClientCNs) > 0
+}
+
+// role returns the role of the request, and whether it is authenticated at all
+func (a AccessRules) role(r *http.Request) (string, bool) {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token := strings.TrimPrefix(auth, "Bearer ")
+		for t, role := range a.Tokens {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+				return role, true
+			}
+		}
+	}
+
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		if role, ok := a.ClientCNs[r.TLS.VerifiedChains[0][0].Subject.CommonName]; ok {
+			return role, true
+		}
+	}
+	return "", false
+}
+
+// allows returns whether the role grants the required one
+func allows(role, required string) bool {
+	return role == RoleOperator || role == required
+}
+
+// checkAccess fails the request unless it has the required role. Operator
+// access is always required to be configured explicitly.
+func checkAccess(w http.ResponseWriter, r *http.Request, rules AccessRules, required string) bool {
+	if !rules.enabled() {
+		if required == RoleOperator {
+			http.Error(w, "admin api is disabled, set an admin token to enable it", http.StatusForbidden)
+			return false
+		}
+		return true
+	}
+
+	role, ok := rules.role(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "invalid credentials", http.StatusUnauthorized)
+		return false
+	}
+	if !allows(role, required) {
+		http.Error(w, fmt.Sprintf("role %s is not allowed, it requires %s", role, required), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// withAccess wraps a handler so it requires the given role
+func withAccess(rules AccessRules, required string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if checkAccess(w, r, rules, required) {
+			h.ServeHTTP(w, r)
+		}
+	})
+}
+
+// PprofMux returns a mux with the pprof endpoints, protected by the access rules
+func PprofMux(rules AccessRules) *http.ServeMux {
+	mux := http.NewServeMux()
+	registerPprof(mux, rules)
+	return mux
+}
+
+func registerPprof(mux *http.ServeMux, rules AccessRules) {
+	mux.Handle("/debug/pprof/", withAccess(rules, RoleReadOnly, http.HandlerFunc(pprof.Index)))
+	mux.Handle("/debug/pprof/cmdline", withAccess(rules, RoleReadOnly, http.HandlerFunc(pprof.Cmdline)))
+	mux.Handle("/debug/pprof/profile", withAccess(rules, RoleReadOnly, http.HandlerFunc(pprof.Profile)))
+	mux.Handle("/debug/pprof/symbol", withAccess(rules, RoleReadOnly, http.HandlerFunc(pprof.Symbol)))
+	mux.Handle("/debug/pprof/trace", withAccess(rules, RoleReadOnly, http.HandlerFunc(pprof.Trace)))
+}
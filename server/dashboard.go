@@ -0,0 +1,114 @@
+package server
+
+import (
+	"bytes"
+	"html/template"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gitlab.com/yakshaving.art/git-pull-mirror/version"
+)
+
+var dashboardTemplate = template.Must(template.New("dashboard").Funcs(template.FuncMap{
+	"since": func(t *time.Time) string {
+		if t == nil {
+			return "never"
+		}
+		return time.Since(*t).Truncate(time.Second).String() + " ago"
+	},
+	"timestamp": func(t *time.Time) string {
+		if t == nil {
+			return ""
+		}
+		return t.UTC().Format(time.RFC3339)
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="30">
+<title>git-pull-mirror</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; width: 100%; }
+th, td { text-align: left; padding: 0.4em 0.8em; border-bottom: 1px solid #ddd; vertical-align: top; }
+th { background: #f4f4f4; }
+.idle { color: #2a7d2a; }
+.queued, .running { color: #1f5fa8; }
+.paused { color: #a86b1f; }
+.degraded { color: #b42318; }
+.error { color: #b42318; font-size: 0.9em; }
+.muted { color: #777; font-size: 0.9em; }
+</style>
+</head>
+<body>
+<h1>git-pull-mirror</h1>
+<p class="muted">{{ len .Repositories }} mirrors, version {{ .Version }}, refreshed every 30 seconds</p>
+<table>
+<tr><th>Mirror</th><th>State</th><th>Last fetch</th><th>Last push</th><th>Refs</th><th>Webhook</th><th>Last error</th><th></th></tr>
+{{ range .Repositories }}
+<tr>
+<td>{{ .Origin }}<br><span class="muted">&rarr; {{ .Target }}</span></td>
+<td class="{{ .State }}">{{ .State }}{{ if .Pending }} ({{ .Pending }} pending){{ end }}</td>
+<td title="{{ timestamp .LastFetch }}">{{ since .LastFetch }}</td>
+<td title="{{ timestamp .LastPush }}">{{ since .LastPush }}</td>
+<td>{{ .Refs.Branches }} branches, {{ .Refs.Tags }} tags</td>
+<td>{{ if not .Webhook }}<span class="muted">none</span>{{ else if .Webhook.Registered }}registered{{ else }}<span class="error">not registered</span>{{ end }}</td>
+<td>{{ if .LastError }}<span class="error" title="{{ timestamp .LastErrorTime }}">{{ .LastError }}</span>{{ end }}</td>
+<td><button onclick="sync('{{ .Key }}', this)">Sync now</button></td>
+</tr>
+{{ else }}
+<tr><td colspan="8" class="muted">No mirrors configured</td></tr>
+{{ end }}
+</table>
+<script>
+function sync(key, button) {
+  var token = sessionStorage.getItem("adminToken") || prompt("Admin token");
+  if (!token) { return; }
+  button.disabled = true;
+  fetch("/api/v1/repos/" + key + "/sync", { method: "POST", headers: { "Authorization": "Bearer " + token } })
+    .then(function (res) {
+      if (res.status === 401) { sessionStorage.removeItem("adminToken"); }
+      else { sessionStorage.setItem("adminToken", token); }
+      button.textContent = res.ok ? "Queued" : "Failed: " + res.status;
+    })
+    .catch(function (err) { button.textContent = "Failed: " + err; });
+}
+</script>
+</body>
+</html>
+`))
+
+// DashboardHandler renders an html page with the status of every mirror
+func (ws *WebHooksServer) DashboardHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkAccess(w, r, ws.opts.DashboardAccess, RoleReadOnly) {
+		return
+	}
+
+	statuses := ws.status.list()
+	for i := range statuses {
+		statuses[i].Webhook = ws.webhookStatus(statuses[i].Key)
+	}
+
+	b := &bytes.Buffer{}
+	err := dashboardTemplate.Execute(b, struct {
+		Version      string
+		Repositories []RepositoryStatus
+	}{
+		Version:      version.Version,
+		Repositories: statuses,
+	})
+	if err != nil {
+		logrus.Errorf("failed to render dashboard: %s", err)
+		http.Error(w, "failed to render dashboard", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	b.WriteTo(w)
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/jpillora/backoff"
+	"github.com/pborman/uuid"
+	"github.com/sirupsen/logrus"
+	"gitlab.com/yakshaving.art/git-pull-mirror/audit"
+	"gitlab.com/yakshaving.art/git-pull-mirror/config"
+	"gitlab.com/yakshaving.art/git-pull-mirror/metrics"
+)
+
+// degradedRepository is a configured repository that failed to be set up, it
+// is retried in the background with backoff until it succeeds
+type degradedRepository struct {
+	config      config.RepositoryConfig
+	nextAttempt time.Time
+	backoff     *backoff.Backoff
+}
+
+func newDegradedRepository(r config.RepositoryConfig) *degradedRepository {
+	d := &degradedRepository{
+		config: r,
+		backoff: &backoff.Backoff{
+			Min:    10 * time.Second,
+			Max:    10 * time.Minute,
+			Factor: 2,
+			Jitter: true,
+		},
+	}
+	d.nextAttempt = time.Now().Add(d.backoff.Duration())
+	return d
+}
+
+// retryDegradedLoop retries the degraded repositories that are due until the
+// server is shut down
+func (ws *WebHooksServer) retryDegradedLoop() {
+	ticker := time.NewTicker(reconcileTick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ws.done:
+			return
+		case <-ticker.C:
+			ws.retryDue(ws.dueDegraded(time.Now()))
+		}
+	}
+}
+
+// retryDue retries the degraded repositories, as many at the same time as
+// when applying the configuration
+func (ws *WebHooksServer) retryDue(keys []string) {
+	slots := make(chan interface{}, ws.opts.ConfigConcurrency)
+	wg := &sync.WaitGroup{}
+	for _, key := range keys {
+		slots <- true
+		wg.Add(1)
+		go func(key string) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			ws.retryDegraded(key)
+		}(key)
+	}
+	wg.Wait()
+}
+
+// dueDegraded returns the keys of the degraded repositories to retry
+func (ws *WebHooksServer) dueDegraded(now time.Time) []string {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+
+	due := make([]string, 0)
+	for key, d := range ws.degraded {
+		if !now.Before(d.nextAttempt) {
+			due = append(due, key)
+		}
+	}
+	return due
+}
+
+// retryDegraded sets up a degraded repository again, activating it and
+// enqueueing an update to catch up when it succeeds. It is set up without
+// holding the configuration lock, which is only taken to swap it in if it is
+// still degraded, so the clone doesn't block reloads and api changes.
+func (ws *WebHooksServer) retryDegraded(key string) {
+	ws.lock.Lock()
+	d, ok := ws.degraded[key]
+	ws.lock.Unlock()
+	if !ok {
+		// It was removed or put again in the meantime
+		return
+	}
+
+	repo, err := ws.setupRepository(newGitClient(ws.ctx, ws.opts), d.config)
+
+	ws.configLock.Lock()
+	defer ws.configLock.Unlock()
+
+	ws.lock.Lock()
+	current, ok := ws.degraded[key]
+	configured := ws.isConfigured(key)
+	ws.lock.Unlock()
+	if !ok || current != d {
+		logrus.Infof("repository %s was removed or put again while retrying it, discarding the retry", d.config.OriginURL)
+		if err == nil && !configured {
+			ws.webhooks.Unregister(d.config.OriginURL)
+		}
+		return
+	}
+
+	if err != nil {
+		ws.lock.Lock()
+		d.nextAttempt = time.Now().Add(d.backoff.Duration())
+		ws.status.degraded(key, d.nextAttempt)
+		ws.lock.Unlock()
+
+		logrus.Warnf("repository %s is still degraded, retrying at %s: %s", d.config.OriginURL, d.nextAttempt.Format(time.RFC3339), err)
+		return
+	}
+
+	ws.lock.Lock()
+	delete(ws.degraded, key)
+	ws.repositories[key] = repo
+	ws.status.recovered(key)
+	metrics.ReposConfigured.Set(float64(len(ws.repositories)))
+	ws.lock.Unlock()
+
+	metrics.RepoIsUp.WithLabelValues(d.config.OriginURL.ToPath()).Set(1)
+	logrus.Infof("repository %s recovered, enqueuing an update to catch up", d.config.OriginURL)
+
+	ws.schedulePolls()
+	ws.enqueue(pullTask{id: uuid.NewUUID().String(), source: audit.SourceRecovered, repo: repo})
+}
+
+// isConfigured returns whether the repository is in the configuration, it
+// requires holding the lock
+func (ws *WebHooksServer) isConfigured(key string) bool {
+	for _, r := range ws.config.Repositories {
+		if r.OriginURL.ToKey() == key {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,407 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gitlab.com/yakshaving.art/git-pull-mirror/audit"
+	"gitlab.com/yakshaving.art/git-pull-mirror/config"
+	"gitlab.com/yakshaving.art/git-pull-mirror/metrics"
+	git "gopkg.in/src-d/go-git.v4"
+	gitconfig "gopkg.in/src-d/go-git.v4/config"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+)
+
+// targetRefsNamespace is where the target branches and tags are fetched to
+// find divergences and what changes in every push
+const targetRefsNamespace = "refs/mirror-target/"
+
+// backupRefsPrefix is where the tips of the rewritten branches are backed up
+const backupRefsPrefix = "refs/mirror-backup/"
+
+// Actions taken on the divergent branches, as counted in the divergent refs metric
+const (
+	divergenceOverwritten = "overwritten"
+	divergenceSkipped     = "skipped"
+	divergenceAlerted     = "alerted"
+)
+
+// maxLostCommits is the maximum number of lost commits that will be logged per ref
+const maxLostCommits = 50
+
+// rewrite is a branch that was updated in origin with a non fast forward
+type rewrite struct {
+	branch string
+	old    plumbing.Hash
+	new    plumbing.Hash
+}
+
+// divergence is a branch in which the target has commits that the origin doesn't
+type divergence struct {
+	branch string
+	origin plumbing.Hash
+	target plumbing.Hash
+	lost   []plumbing.Hash
+}
+
+// pushRefSpecs returns the refspecs to push to target after applying the
+// divergence policy of the repository to the branches that diverged, and the
+// refs that will be updated by the push
+func (r Repository) pushRefSpecs() ([]gitconfig.RefSpec, []audit.RefUpdate, error) {
+	if err := r.fetchTarget(); err != nil {
+		return nil, nil, err
+	}
+
+	local, err := r.localRefs()
+	if err != nil {
+		return nil, nil, err
+	}
+	local = r.filterRefs(local)
+
+	divergences, err := r.findDivergences(local)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	skipped := make(map[string]bool, len(divergences))
+	for _, d := range divergences {
+		lost := make([]string, 0, len(d.lost))
+		for _, h := range d.lost {
+			lost = append(lost, h.String())
+		}
+
+		action := divergenceOverwritten
+		switch r.settings.onDivergence {
+		case config.DivergenceSkip:
+			logrus.Warnf("branch %s diverged in %s (%s != %s), skipping it", d.branch, r.target, d.target, d.origin)
+			skipped[d.branch] = true
+			action = divergenceSkipped
+
+		case config.DivergenceAlert:
+			logrus.Errorf("ALERT: branch %s diverged in %s (%s != %s), not pushing it, commits only in target: %s",
+				d.branch, r.target, d.target, d.origin, strings.Join(lost, ", "))
+			skipped[d.branch] = true
+			action = divergenceAlerted
+
+		default:
+			logrus.Warnf("branch %s diverged in %s (%s != %s), overwriting it, lost commits: %s",
+				d.branch, r.target, d.target, d.origin, strings.Join(lost, ", "))
+		}
+		metrics.DivergentRefsTotal.WithLabelValues(r.origin.ToPath(), action).Inc()
+	}
+
+	target, err := r.targetRefs()
+	if err != nil {
+		return nil, nil, err
+	}
+	target = r.filterRefs(target)
+
+	updates := r.refUpdates(local, target, skipped)
+
+	refSpecs := make([]gitconfig.RefSpec, 0, len(local))
+	for name := range local {
+		if !name.IsBranch() || skipped[name.Short()] {
+			continue
+		}
+		refSpecs = append(refSpecs, gitconfig.RefSpec(fmt.Sprintf("+refs/remotes/%s/%s:%s", OriginRemote, name.Short(), name)))
+	}
+	for _, update := range updates {
+		if update.Action == audit.ActionDeleted {
+			refSpecs = append(refSpecs, gitconfig.RefSpec(":"+update.Ref))
+		}
+	}
+	if len(r.settings.refs) == 0 {
+		refSpecs = append(refSpecs, "+refs/tags/*:refs/tags/*")
+		return refSpecs, updates, nil
+	}
+	for name := range local {
+		if name.IsTag() {
+			refSpecs = append(refSpecs, gitconfig.RefSpec(fmt.Sprintf("+%s:%s", name, name)))
+		}
+	}
+
+	return refSpecs, updates, nil
+}
+
+// refUpdates compares the local refs with the fetched target ones and returns
+// the ones that differ, sorted by name. The target refs that are not in origin
+// are kept, and left out, unless the repository prunes the target.
+func (r Repository) refUpdates(local, target map[plumbing.ReferenceName]plumbing.Hash, skipped map[string]bool) []audit.RefUpdate {
+	updates := make([]audit.RefUpdate, 0)
+	for name, hash := range local {
+		old := target[name]
+		if old == hash {
+			continue
+		}
+
+		update := audit.RefUpdate{
+			Ref:    name.String(),
+			New:    hash.String(),
+			Action: audit.ActionPushed,
+		}
+		if !old.IsZero() {
+			update.Old = old.String()
+		}
+		if name.IsBranch() && skipped[name.Short()] {
+			update.Action = audit.ActionSkipped
+		}
+		updates = append(updates, update)
+	}
+
+	for name, old := range target {
+		if _, ok := local[name]; ok || !r.settings.pruneTarget {
+			continue
+		}
+
+		updates = append(updates, audit.RefUpdate{
+			Ref:    name.String(),
+			Old:    old.String(),
+			Action: audit.ActionDeleted,
+		})
+	}
+
+	sort.Slice(updates, func(i, j int) bool {
+		return updates[i].Ref < updates[j].Ref
+	})
+	return updates
+}
+
+// targetRefs returns the fetched target branches and tags, named as they are in target
+func (r Repository) targetRefs() (map[plumbing.ReferenceName]plumbing.Hash, error) {
+	refs, err := r.repo.References()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list target refs of %s: %s", r.target, err)
+	}
+	defer refs.Close()
+
+	target := make(map[plumbing.ReferenceName]plumbing.Hash)
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() == plumbing.HashReference && strings.HasPrefix(ref.Name().String(), targetRefsNamespace) {
+			target[plumbing.ReferenceName("refs/"+strings.TrimPrefix(ref.Name().String(), targetRefsNamespace))] = ref.Hash()
+		}
+		return nil
+	})
+	return target, err
+}
+
+// clearTargetRefs removes the fetched target refs, as fetching doesn't remove
+// the ones that were deleted in target
+func (r Repository) clearTargetRefs() error {
+	target, err := r.targetRefs()
+	if err != nil {
+		return err
+	}
+	for name := range target {
+		ref := plumbing.ReferenceName(targetRefsNamespace + strings.TrimPrefix(name.String(), "refs/"))
+		if err = r.repo.Storer.RemoveReference(ref); err != nil {
+			return fmt.Errorf("failed to remove target ref %s: %s", ref, err)
+		}
+	}
+	return nil
+}
+
+// targetRef returns the hash of the given ref in the fetched target, or the
+// zero hash if target doesn't have it
+func (r Repository) targetRef(name plumbing.ReferenceName) (plumbing.Hash, error) {
+	ref, err := r.repo.Reference(plumbing.ReferenceName(targetRefsNamespace+strings.TrimPrefix(name.String(), "refs/")), false)
+	if err == plumbing.ErrReferenceNotFound {
+		return plumbing.ZeroHash, nil
+	}
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("failed to read target ref for %s: %s", name, err)
+	}
+	return ref.Hash(), nil
+}
+
+// fetchTarget fetches the target branches and tags so we can compare them with the origin ones
+func (r Repository) fetchTarget() error {
+	auth, err := r.client.authMethod(TargetRemote, r.target)
+	if err != nil {
+		return fmt.Errorf("failed set up auth to fetch from target %s: %s", r.target, err)
+	}
+
+	if err = r.clearTargetRefs(); err != nil {
+		return err
+	}
+
+	ctx, cancel := r.client.withTimeout()
+	defer cancel()
+
+	logrus.Debugf("fetching target %s", r.target)
+	err = r.repo.FetchContext(ctx, &git.FetchOptions{
+		Auth:       auth,
+		RemoteName: TargetRemote,
+		Tags:       git.NoTags,
+		RefSpecs: []gitconfig.RefSpec{
+			gitconfig.RefSpec("+refs/heads/*:" + targetRefsNamespace + "heads/*"),
+			gitconfig.RefSpec("+refs/tags/*:" + targetRefsNamespace + "tags/*"),
+		},
+	})
+	switch err {
+	case nil, git.NoErrAlreadyUpToDate, transport.ErrEmptyRemoteRepository:
+		return nil
+	}
+	return fmt.Errorf("failed to fetch target %s: %s", r.target, err)
+}
+
+// findDivergences compares the local origin branches with the fetched target
+// ones, returning the ones in which updating the target would not be a fast forward
+func (r Repository) findDivergences(local map[plumbing.ReferenceName]plumbing.Hash) ([]divergence, error) {
+	divergences := make([]divergence, 0)
+	for name, originHash := range local {
+		if !name.IsBranch() {
+			continue
+		}
+
+		targetHash, err := r.targetRef(name)
+		if err != nil {
+			return nil, err
+		}
+		if targetHash.IsZero() || targetHash == originHash {
+			continue
+		}
+
+		fastForward, seen, err := r.reaches(originHash, targetHash)
+		if err != nil {
+			return nil, fmt.Errorf("failed to walk %s history: %s", name, err)
+		}
+		if fastForward {
+			continue
+		}
+
+		// The walk didn't reach target, so it saw the whole origin history
+		lost, err := r.missingFrom(targetHash, seen)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find lost commits in %s: %s", name, err)
+		}
+
+		divergences = append(divergences, divergence{
+			branch: name.Short(),
+			origin: originHash,
+			target: targetHash,
+			lost:   lost,
+		})
+	}
+	return divergences, nil
+}
+
+// reaches walks the history from the given commit, nearest commits first,
+// until it reaches the target one. It returns whether the target was reached
+// and the commits seen, which are all the ones reachable when it wasn't.
+func (r Repository) reaches(from, target plumbing.Hash) (bool, map[plumbing.Hash]bool, error) {
+	seen := map[plumbing.Hash]bool{from: true}
+	pending := []plumbing.Hash{from}
+
+	for len(pending) > 0 {
+		h := pending[0]
+		pending = pending[1:]
+		if h == target {
+			return true, seen, nil
+		}
+
+		c, err := r.repo.CommitObject(h)
+		if err != nil {
+			return false, nil, fmt.Errorf("failed to read commit %s: %s", h, err)
+		}
+		for _, p := range c.ParentHashes {
+			if !seen[p] {
+				seen[p] = true
+				pending = append(pending, p)
+			}
+		}
+	}
+	return false, seen, nil
+}
+
+// isAncestor returns whether the ancestor commit is reachable from the other
+// one, which for fast forwards only walks the new commits
+func (r Repository) isAncestor(ancestor, of plumbing.Hash) (bool, error) {
+	reached, _, err := r.reaches(of, ancestor)
+	return reached, err
+}
+
+// findRewrites compares the origin branches before and after a fetch and
+// returns the ones that were force pushed
+func (r Repository) findRewrites(before, after map[plumbing.ReferenceName]plumbing.Hash) ([]rewrite, error) {
+	rewrites := make([]rewrite, 0)
+	for name, old := range before {
+		if !name.IsBranch() {
+			continue
+		}
+		new, ok := after[name]
+		if !ok || new == old {
+			continue
+		}
+
+		fastForward, err := r.isAncestor(old, new)
+		if err != nil {
+			return nil, fmt.Errorf("failed to walk %s history: %s", name, err)
+		}
+		if !fastForward {
+			rewrites = append(rewrites, rewrite{branch: name.Short(), old: old, new: new})
+		}
+	}
+	return rewrites, nil
+}
+
+// backupRewrite pushes the old tip of a rewritten branch to a backup ref in
+// target, so the history that origin dropped is not lost in the mirror
+func (r Repository) backupRewrite(rw rewrite, at time.Time) error {
+	name := plumbing.ReferenceName(fmt.Sprintf("%s%s/%s", backupRefsPrefix, at.UTC().Format("20060102T150405Z"), rw.branch))
+	if err := r.repo.Storer.SetReference(plumbing.NewHashReference(name, rw.old)); err != nil {
+		return fmt.Errorf("failed to create backup ref %s: %s", name, err)
+	}
+
+	auth, err := r.client.authMethod(TargetRemote, r.target)
+	if err != nil {
+		return fmt.Errorf("failed set up auth to push to target %s: %s", r.target, err)
+	}
+
+	ctx, cancel := r.client.withTimeout()
+	defer cancel()
+
+	logrus.Infof("backing up %s of %s to %s in %s", rw.old, rw.branch, name, r.target)
+	err = r.repo.PushContext(ctx, &git.PushOptions{
+		Auth:       auth,
+		RemoteName: TargetRemote,
+		RefSpecs:   []gitconfig.RefSpec{gitconfig.RefSpec(fmt.Sprintf("%s:%s", name, name))},
+	})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return fmt.Errorf("failed to push backup ref %s to %s: %s", name, r.target, err)
+	}
+	return nil
+}
+
+// missingFrom returns the commits reachable from the given one that are not in
+// the known set, up to maxLostCommits
+func (r Repository) missingFrom(from plumbing.Hash, known map[plumbing.Hash]bool) ([]plumbing.Hash, error) {
+	missing := make([]plumbing.Hash, 0)
+	seen := map[plumbing.Hash]bool{from: true}
+	pending := []plumbing.Hash{from}
+
+	for len(pending) > 0 && len(missing) < maxLostCommits {
+		h := pending[0]
+		pending = pending[1:]
+
+		if known[h] {
+			continue
+		}
+		missing = append(missing, h)
+
+		c, err := r.repo.CommitObject(h)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read commit %s: %s", h, err)
+		}
+		for _, p := range c.ParentHashes {
+			if !seen[p] {
+				seen[p] = true
+				pending = append(pending, p)
+			}
+		}
+	}
+	return missing, nil
+}
@@ -5,17 +5,22 @@ import (
 	"fmt"
 	"io/ioutil"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/jpillora/backoff"
 	"github.com/sirupsen/logrus"
+	"gitlab.com/yakshaving.art/git-pull-mirror/audit"
+	"gitlab.com/yakshaving.art/git-pull-mirror/config"
 	"gitlab.com/yakshaving.art/git-pull-mirror/metrics"
 	"gitlab.com/yakshaving.art/git-pull-mirror/url"
 	"golang.org/x/crypto/ssh"
 	git "gopkg.in/src-d/go-git.v4"
-	"gopkg.in/src-d/go-git.v4/config"
+	gitconfig "gopkg.in/src-d/go-git.v4/config"
+	"gopkg.in/src-d/go-git.v4/plumbing"
 	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+	githttp "gopkg.in/src-d/go-git.v4/plumbing/transport/http"
 	gitssh "gopkg.in/src-d/go-git.v4/plumbing/transport/ssh"
 )
 
@@ -27,10 +32,20 @@ const (
 
 // Repository is a git repo that enables to pull and push. Having an instance of this object means that we have a valid repo
 type Repository struct {
-	repo   *git.Repository
-	origin url.GitURL
-	target url.GitURL
-	client gitClient
+	repo     *git.Repository
+	origin   url.GitURL
+	target   url.GitURL
+	client   gitClient
+	settings repositorySettings
+}
+
+// repositorySettings are the per repository behaviors defined in the configuration
+type repositorySettings struct {
+	onDivergence   string
+	backupRewrites bool
+	pruneTarget    bool
+	// refs are the patterns of the branches and tags to mirror, all of them when empty
+	refs []string
 }
 
 func (r Repository) updateRemotes() error {
@@ -40,17 +55,17 @@ func (r Repository) updateRemotes() error {
 	}
 	if remote.Config().URLs[0] != r.origin.URI {
 		r.repo.DeleteRemote(OriginRemote)
-		if _, err = r.repo.CreateRemote(&config.RemoteConfig{
+		if _, err = r.repo.CreateRemote(&gitconfig.RemoteConfig{
 			Name:  OriginRemote,
 			URLs:  []string{r.origin.URI},
-			Fetch: []config.RefSpec{"+refs/heads/*:refs/remotes/origin/*", "+refs/tags/*:refs/tags/*"},
+			Fetch: []gitconfig.RefSpec{"+refs/heads/*:refs/remotes/origin/*", "+refs/tags/*:refs/tags/*"},
 		}); err != nil {
 			return fmt.Errorf("could not update origin remote: %s", err)
 		}
 	}
 
 	createTarget := func() error {
-		if _, err := r.repo.CreateRemote(&config.RemoteConfig{
+		if _, err := r.repo.CreateRemote(&gitconfig.RemoteConfig{
 			Name: TargetRemote,
 			URLs: []string{r.target.URI},
 		}); err != nil {
@@ -73,22 +88,53 @@ func (r Repository) updateRemotes() error {
 	return nil
 }
 
-func newGitClient(ops WebHooksServerOptions) gitClient {
-	return gitClient{ops: ops}
+func newGitClient(ctx context.Context, ops WebHooksServerOptions) gitClient {
+	return gitClient{ctx: ctx, ops: ops}
 }
 
 type gitClient struct {
+	// ctx is cancelled to abort all the git operations, like when shutting down
+	ctx context.Context
 	ops WebHooksServerOptions
+	// credentials authenticate against the remotes of a single repository
+	credentials config.Credentials
 
 	repositories []Repository
 	wg           *sync.WaitGroup
 }
 
+// withCredentials returns a client that authenticates with the credentials
+func (g gitClient) withCredentials(credentials config.Credentials) gitClient {
+	g.credentials = credentials
+	return g
+}
+
+// credentialsFor returns the credentials of the remote, so the origin ones are
+// never sent to the target and the other way around
+func (g gitClient) credentialsFor(remote string) config.RemoteCredentials {
+	var credentials *config.RemoteCredentials
+	switch remote {
+	case OriginRemote:
+		credentials = g.credentials.Origin
+	case TargetRemote:
+		credentials = g.credentials.Target
+	}
+	if credentials == nil {
+		return config.RemoteCredentials{}
+	}
+	return *credentials
+}
+
 // GitTimeoutSeconds returns the duration in which the context for a git operation will timeout
 func (g gitClient) GitTimeoutSeconds() time.Duration {
 	return time.Duration(g.ops.GitTimeoutSeconds) * time.Second
 }
 
+// withTimeout returns the context for a git operation
+func (g gitClient) withTimeout() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(g.ctx, g.GitTimeoutSeconds())
+}
+
 // CloneOrPull ensures that the repo exists in the indicated path
 func (g gitClient) CloneOrOpen(origin url.GitURL, target url.GitURL) (Repository, error) {
 	r, err := git.PlainOpen(g.pathFor(origin))
@@ -114,12 +160,12 @@ func (g gitClient) CloneOrOpen(origin url.GitURL, target url.GitURL) (Repository
 func (g gitClient) clone(origin url.GitURL, target url.GitURL) (Repository, error) {
 	logrus.Debugf("could not find repository %s, cloning into %s", origin, g.pathFor(origin))
 
-	auth, err := g.authMethod(origin)
+	auth, err := g.authMethod(OriginRemote, origin)
 	if err != nil {
 		return Repository{}, fmt.Errorf("failed set up auth to clone origin %s: %s", origin, err)
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), g.GitTimeoutSeconds())
+	ctx, cancel := g.withTimeout()
 	defer cancel()
 
 	r, err := git.PlainCloneContext(ctx, g.pathFor(origin), true, &git.CloneOptions{
@@ -131,7 +177,7 @@ func (g gitClient) clone(origin url.GitURL, target url.GitURL) (Repository, erro
 	}
 
 	logrus.Debugf("creating remote `target` for %s", origin)
-	_, err = r.CreateRemote(&config.RemoteConfig{
+	_, err = r.CreateRemote(&gitconfig.RemoteConfig{
 		Name: TargetRemote,
 		URLs: []string{target.URI},
 	})
@@ -153,24 +199,31 @@ func (g gitClient) pathFor(origin url.GitURL) string {
 	return filepath.Join(g.ops.RepositoriesPath, origin.ToPath())
 }
 
-func (g gitClient) authMethod(uri url.GitURL) (transport.AuthMethod, error) {
+// authMethod returns how to authenticate against the remote, with its own
+// credentials only
+func (g gitClient) authMethod(remote string, uri url.GitURL) (transport.AuthMethod, error) {
+	credentials := g.credentialsFor(remote)
 	switch uri.Transport {
 	case url.GitSSHTransport:
-		if g.ops.SSHPrivateKey == "" {
+		key := g.ops.SSHPrivateKey
+		if credentials.SSHKey != "" {
+			key = credentials.SSHKey
+		}
+		if key == "" {
 			logrus.Debugf("%s transport for %s but no ssh pk set", uri.Transport, uri)
 			break
 		}
 
-		logrus.Debugf("loading private key %s for %s", g.ops.SSHPrivateKey, uri)
+		logrus.Debugf("loading private key %s for %s", key, uri)
 
-		pem, err := ioutil.ReadFile(g.ops.SSHPrivateKey)
+		pem, err := ioutil.ReadFile(key)
 		if err != nil {
-			return nil, fmt.Errorf("failed to read ssh private key %s: %s", g.ops.SSHPrivateKey, err)
+			return nil, fmt.Errorf("failed to read ssh private key %s: %s", key, err)
 		}
 
 		signer, err := ssh.ParsePrivateKey(pem)
 		if err != nil {
-			return nil, fmt.Errorf("failed to parse ssh private key %s: %s", g.ops.SSHPrivateKey, err)
+			return nil, fmt.Errorf("failed to parse ssh private key %s: %s", key, err)
 		}
 
 		return &gitssh.PublicKeys{
@@ -178,18 +231,36 @@ func (g gitClient) authMethod(uri url.GitURL) (transport.AuthMethod, error) {
 			Signer: signer,
 		}, nil
 
+	case url.GitHTTPTransport:
+		if credentials.PasswordFile == "" {
+			break
+		}
+
+		password, err := ioutil.ReadFile(credentials.PasswordFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read password file %s: %s", credentials.PasswordFile, err)
+		}
+
+		username := credentials.Username
+		if username == "" {
+			username = uri.Username
+		}
+		return &githttp.BasicAuth{
+			Username: username,
+			Password: strings.TrimSpace(string(password)),
+		}, nil
 	}
 	return nil, nil
 }
 
 // Fetch pulls from origin
 func (r Repository) Fetch() error {
-	auth, err := r.client.authMethod(r.origin)
+	auth, err := r.client.authMethod(OriginRemote, r.origin)
 	if err != nil {
 		return fmt.Errorf("failed set up auth to fetch from origin %s: %s", r.origin, err)
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), r.client.GitTimeoutSeconds())
+	ctx, cancel := r.client.withTimeout()
 	defer cancel()
 
 	logrus.Debugf("fetching %s", r.origin)
@@ -197,18 +268,175 @@ func (r Repository) Fetch() error {
 		Auth:       auth,
 		RemoteName: OriginRemote,
 	})
-	if err == git.NoErrAlreadyUpToDate {
+	switch err {
+	case nil:
+	case git.NoErrAlreadyUpToDate:
 		logrus.Debugf("%s is already up to date", r.origin)
+	default:
+		return err
+	}
+	if !r.settings.pruneTarget {
+		return nil
+	}
+	return r.prune()
+}
+
+// prune removes the local branches and tags that were deleted in origin, as
+// fetching doesn't, so they are deleted from target too when pushing. It is
+// only done for the repositories that prune the target.
+func (r Repository) prune() error {
+	remote, err := r.remoteRefs(OriginRemote, r.origin)
+	if err != nil {
+		return err
+	}
+	if len(remote) == 0 {
+		logrus.Warnf("%s has no branches or tags, not removing them from the mirror", r.origin)
 		return nil
 	}
-	return err
+
+	local, err := r.localRefs()
+	if err != nil {
+		return err
+	}
+
+	for name := range local {
+		if _, ok := remote[name]; ok {
+			continue
+		}
+
+		ref := name
+		if name.IsBranch() {
+			ref = plumbing.ReferenceName("refs/remotes/" + OriginRemote + "/" + name.Short())
+		}
+		logrus.Debugf("%s was deleted in %s, removing it", name, r.origin)
+		if err = r.repo.Storer.RemoveReference(ref); err != nil {
+			return fmt.Errorf("failed to remove %s deleted in %s: %s", name, r.origin, err)
+		}
+	}
+	return nil
 }
 
-// Push pushes to target
-func (r Repository) Push() error {
-	auth, err := r.client.authMethod(r.target)
+// HasChanges compares the refs advertised by origin with the local ones to
+// find out if there is anything to fetch without downloading any object
+func (r Repository) HasChanges() (bool, error) {
+	remote, err := r.remoteRefs(OriginRemote, r.origin)
+	if err != nil {
+		return false, err
+	}
+
+	local, err := r.localRefs()
 	if err != nil {
-		return fmt.Errorf("failed set up auth to push to target %s: %s", r.target, err)
+		return false, err
+	}
+
+	return !refsEqual(r.filterRefs(remote), local), nil
+}
+
+// InSync compares the refs advertised by origin with the ones advertised by
+// target to find out if the mirror has drifted
+func (r Repository) InSync() (bool, error) {
+	origin, err := r.remoteRefs(OriginRemote, r.origin)
+	if err != nil {
+		return false, err
+	}
+
+	target, err := r.remoteRefs(TargetRemote, r.target)
+	if err != nil {
+		return false, err
+	}
+
+	return refsEqual(r.filterRefs(origin), target), nil
+}
+
+// refsEqual returns whether all the refs in origin point to the same hash in other
+func refsEqual(origin, other map[plumbing.ReferenceName]plumbing.Hash) bool {
+	for name, hash := range origin {
+		if h, ok := other[name]; !ok || h != hash {
+			logrus.Debugf("%s differs: %s != %s", name, hash, h)
+			return false
+		}
+	}
+	return true
+}
+
+// remoteRefs lists the branches and tags advertised by a remote, like ls-remote does
+func (r Repository) remoteRefs(remoteName string, u url.GitURL) (map[plumbing.ReferenceName]plumbing.Hash, error) {
+	auth, err := r.client.authMethod(remoteName, u)
+	if err != nil {
+		return nil, fmt.Errorf("failed set up auth to list %s %s: %s", remoteName, u, err)
+	}
+
+	remote, err := r.repo.Remote(remoteName)
+	if err != nil {
+		return nil, fmt.Errorf("could not obtain %s remote from repo %s: %s", remoteName, r.origin, err)
+	}
+
+	refs, err := remote.List(&git.ListOptions{Auth: auth})
+	if err == transport.ErrEmptyRemoteRepository {
+		return map[plumbing.ReferenceName]plumbing.Hash{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list refs from %s %s: %s", remoteName, u, err)
+	}
+
+	heads := make(map[plumbing.ReferenceName]plumbing.Hash, len(refs))
+	for _, ref := range refs {
+		if ref.Type() != plumbing.HashReference || strings.HasSuffix(ref.Name().String(), "^{}") {
+			continue
+		}
+		if ref.Name().IsBranch() || ref.Name().IsTag() {
+			heads[ref.Name()] = ref.Hash()
+		}
+	}
+	return heads, nil
+}
+
+// filterRefs returns the refs that match the ref filters of the repository
+func (r Repository) filterRefs(refs map[plumbing.ReferenceName]plumbing.Hash) map[plumbing.ReferenceName]plumbing.Hash {
+	if len(r.settings.refs) == 0 {
+		return refs
+	}
+
+	filtered := make(map[plumbing.ReferenceName]plumbing.Hash, len(refs))
+	for name, hash := range refs {
+		if config.MatchesRefs(r.settings.refs, name.String()) {
+			filtered[name] = hash
+		}
+	}
+	return filtered
+}
+
+// localRefs returns the branches fetched from origin and the tags, named as
+// they are in origin
+func (r Repository) localRefs() (map[plumbing.ReferenceName]plumbing.Hash, error) {
+	refs, err := r.repo.References()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list local refs of %s: %s", r.origin, err)
+	}
+	defer refs.Close()
+
+	prefix := "refs/remotes/" + OriginRemote + "/"
+	heads := make(map[plumbing.ReferenceName]plumbing.Hash)
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() != plumbing.HashReference {
+			return nil
+		}
+		switch {
+		case strings.HasPrefix(ref.Name().String(), prefix):
+			heads[plumbing.ReferenceName("refs/heads/"+strings.TrimPrefix(ref.Name().String(), prefix))] = ref.Hash()
+		case ref.Name().IsTag():
+			heads[ref.Name()] = ref.Hash()
+		}
+		return nil
+	})
+	return heads, err
+}
+
+// Push pushes to target and returns the refs that were updated
+func (r Repository) Push() ([]audit.RefUpdate, error) {
+	auth, err := r.client.authMethod(TargetRemote, r.target)
+	if err != nil {
+		return nil, fmt.Errorf("failed set up auth to push to target %s: %s", r.target, err)
 	}
 
 	b := &backoff.Backoff{
@@ -218,22 +446,24 @@ func (r Repository) Push() error {
 		Jitter: true,
 	}
 
+	refSpecs, updates, err := r.pushRefSpecs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to check divergences with target %s: %s", r.target, err)
+	}
+
 	for {
-		ctx, cancel := context.WithTimeout(context.Background(), r.client.GitTimeoutSeconds())
+		ctx, cancel := r.client.withTimeout()
 		defer cancel()
 
 		logrus.Debugf("pushing to %s", r.target)
 		err = r.repo.PushContext(ctx, &git.PushOptions{
 			Auth:       auth,
 			RemoteName: TargetRemote,
-			RefSpecs: []config.RefSpec{
-				"+refs/remotes/origin/*:refs/heads/*",
-				"+refs/tags/*:refs/tags/*",
-			},
+			RefSpecs:   refSpecs,
 		})
 		if err == git.NoErrAlreadyUpToDate {
 			logrus.Debugf("%s is already up to date", r.target)
-			return nil
+			return updates, nil
 		}
 
 		if err != nil && b.Attempt() < 3 {
@@ -243,6 +473,19 @@ func (r Repository) Push() error {
 			continue
 		}
 
-		return err
+		if err != nil {
+			failed(updates)
+		}
+		return updates, err
+	}
+}
+
+// failed marks the updates that the push would have made as failed, the
+// skipped ones were left alone anyway
+func failed(updates []audit.RefUpdate) {
+	for i := range updates {
+		if updates[i].Action != audit.ActionSkipped {
+			updates[i].Action = audit.ActionFailed
+		}
 	}
 }
@@ -0,0 +1,446 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"gitlab.com/yakshaving.art/git-pull-mirror/audit"
+	"gitlab.com/yakshaving.art/git-pull-mirror/config"
+	"gitlab.com/yakshaving.art/git-pull-mirror/url"
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	githttp "gopkg.in/src-d/go-git.v4/plumbing/transport/http"
+)
+
+// testRepo is a local non bare repository used as origin or target in tests
+type testRepo struct {
+	path string
+	url  url.GitURL
+	repo *git.Repository
+}
+
+func newTestRepo(t *testing.T, dir, owner, name string) testRepo {
+	return initTestRepo(t, dir, owner, name, false)
+}
+
+// newBareTestRepo creates a repository that can be pushed to
+func newBareTestRepo(t *testing.T, dir, owner, name string) testRepo {
+	return initTestRepo(t, dir, owner, name, true)
+}
+
+func initTestRepo(t *testing.T, dir, owner, name string, bare bool) testRepo {
+	path := filepath.Join(dir, "remotes", owner, name)
+	r, err := git.PlainInit(path, bare)
+	must(t, "failed to init test repo", err)
+
+	return testRepo{
+		path: path,
+		repo: r,
+		url: url.GitURL{
+			URI:       "file://" + path,
+			Transport: "file",
+			Domain:    "localhost",
+			Owner:     owner,
+			Name:      name,
+		},
+	}
+}
+
+// commit writes a file and commits it in the current branch, returning the new commit hash
+func (r testRepo) commit(t *testing.T, file, content string) plumbing.Hash {
+	must(t, "failed to write file", ioutil.WriteFile(filepath.Join(r.path, file), []byte(content), 0644))
+
+	w, err := r.repo.Worktree()
+	must(t, "failed to get worktree", err)
+
+	_, err = w.Add(file)
+	must(t, "failed to add file", err)
+
+	h, err := w.Commit("commit "+file, &git.CommitOptions{
+		Author: &object.Signature{Name: "test", Email: "test@localhost", When: time.Now()},
+	})
+	must(t, "failed to commit", err)
+	return h
+}
+
+// commitToBare commits a file in a bare repository through a temporary clone
+func (r testRepo) commitToBare(t *testing.T, file, content string) plumbing.Hash {
+	dir, err := ioutil.TempDir("", "git_test_clone")
+	must(t, "could not create a temporary dir", err)
+	defer os.RemoveAll(dir)
+
+	clone, err := git.PlainClone(dir, false, &git.CloneOptions{URL: r.url.URI})
+	must(t, "failed to clone bare repo", err)
+
+	h := testRepo{path: dir, repo: clone}.commit(t, file, content)
+	must(t, "failed to push to bare repo", clone.Push(&git.PushOptions{}))
+	return h
+}
+
+// head returns the hash the given branch points to
+func (r testRepo) head(t *testing.T, branch string) plumbing.Hash {
+	ref, err := r.repo.Reference(plumbing.ReferenceName("refs/heads/"+branch), false)
+	must(t, "failed to read branch "+branch, err)
+	return ref.Hash()
+}
+
+func newTestGitClient(t *testing.T) (gitClient, string) {
+	dir, err := ioutil.TempDir("", "git_test")
+	must(t, "could not create a temporary dir", err)
+
+	must(t, "could not create repositories dir", os.MkdirAll(filepath.Join(dir, "local"), 0755))
+	return newGitClient(context.Background(), WebHooksServerOptions{
+		GitTimeoutSeconds: 10,
+		RepositoriesPath:  filepath.Join(dir, "local"),
+	}), dir
+}
+
+func TestHasChanges(t *testing.T) {
+	g, dir := newTestGitClient(t)
+	defer os.RemoveAll(dir)
+
+	origin := newTestRepo(t, dir, "origin", "repo")
+	origin.commit(t, "README", "first")
+
+	target := newBareTestRepo(t, dir, "target", "repo")
+
+	repo, err := g.CloneOrOpen(origin.url, target.url)
+	must(t, "failed to clone origin", err)
+
+	changed, err := repo.HasChanges()
+	must(t, "failed to check for changes", err)
+	if changed {
+		t.Fatalf("freshly cloned repository should not have changes")
+	}
+
+	origin.commit(t, "README", "second")
+
+	changed, err = repo.HasChanges()
+	must(t, "failed to check for changes", err)
+	if !changed {
+		t.Fatalf("repository should have changes after a new commit in origin")
+	}
+
+	must(t, "failed to fetch", repo.Fetch())
+
+	changed, err = repo.HasChanges()
+	must(t, "failed to check for changes", err)
+	if changed {
+		t.Fatalf("repository should not have changes after fetching")
+	}
+}
+
+func TestInSync(t *testing.T) {
+	g, dir := newTestGitClient(t)
+	defer os.RemoveAll(dir)
+
+	origin := newTestRepo(t, dir, "origin", "repo")
+	origin.commit(t, "README", "first")
+
+	target := newBareTestRepo(t, dir, "target", "repo")
+
+	repo, err := g.CloneOrOpen(origin.url, target.url)
+	must(t, "failed to clone origin", err)
+
+	inSync, err := repo.InSync()
+	must(t, "failed to compare origin and target", err)
+	if inSync {
+		t.Fatalf("empty target should not be in sync")
+	}
+
+	_, err = repo.Push()
+	must(t, "failed to push", err)
+
+	inSync, err = repo.InSync()
+	must(t, "failed to compare origin and target", err)
+	if !inSync {
+		t.Fatalf("target should be in sync after pushing")
+	}
+
+	origin.commit(t, "README", "second")
+
+	inSync, err = repo.InSync()
+	must(t, "failed to compare origin and target", err)
+	if inSync {
+		t.Fatalf("target should not be in sync after a new commit in origin")
+	}
+}
+
+func TestDivergencePolicies(t *testing.T) {
+	g, dir := newTestGitClient(t)
+	defer os.RemoveAll(dir)
+
+	origin := newTestRepo(t, dir, "origin", "repo")
+	origin.commit(t, "README", "first")
+
+	target := newBareTestRepo(t, dir, "target", "repo")
+
+	repo, err := g.CloneOrOpen(origin.url, target.url)
+	must(t, "failed to clone origin", err)
+	_, err = repo.Push()
+	must(t, "failed to push", err)
+
+	targetOnly := target.commitToBare(t, "TARGET", "committed directly to the mirror")
+	originOnly := origin.commit(t, "README", "second")
+	must(t, "failed to fetch", repo.Fetch())
+
+	for _, policy := range []string{config.DivergenceSkip, config.DivergenceAlert} {
+		repo.settings.onDivergence = policy
+		updates, err := repo.Push()
+		must(t, "failed to push with policy "+policy, err)
+
+		if h := target.head(t, "master"); h != targetOnly {
+			t.Fatalf("policy %s should have kept target at %s, got %s", policy, targetOnly, h)
+		}
+		assertUpdates(t, []audit.RefUpdate{
+			{Ref: "refs/heads/master", Old: targetOnly.String(), New: originOnly.String(), Action: audit.ActionSkipped},
+		}, updates)
+	}
+
+	repo.settings.onDivergence = config.DivergenceOverwrite
+	updates, err := repo.Push()
+	must(t, "failed to push overwriting", err)
+
+	if h := target.head(t, "master"); h != originOnly {
+		t.Fatalf("overwrite should have moved target to %s, got %s", originOnly, h)
+	}
+	assertUpdates(t, []audit.RefUpdate{
+		{Ref: "refs/heads/master", Old: targetOnly.String(), New: originOnly.String(), Action: audit.ActionPushed},
+	}, updates)
+
+	updates, err = repo.Push()
+	must(t, "failed to push again", err)
+	assertUpdates(t, []audit.RefUpdate{}, updates)
+}
+
+func TestWalkingTheHistoryStopsAtTheTarget(t *testing.T) {
+	g, dir := newTestGitClient(t)
+	defer os.RemoveAll(dir)
+
+	origin := newTestRepo(t, dir, "origin", "repo")
+	first := origin.commit(t, "README", "first")
+	second := origin.commit(t, "README", "second")
+	third := origin.commit(t, "README", "third")
+
+	repo, err := g.CloneOrOpen(origin.url, origin.url)
+	must(t, "failed to clone origin", err)
+
+	reached, seen, err := repo.reaches(third, second)
+	must(t, "failed to walk from the tip", err)
+	if !reached || seen[first] {
+		t.Fatalf("walk should reach %s without going past it, got %t and %v", second, reached, seen)
+	}
+
+	reached, seen, err = repo.reaches(second, third)
+	must(t, "failed to walk from the middle", err)
+	if reached || !reflect.DeepEqual(seen, map[plumbing.Hash]bool{first: true, second: true}) {
+		t.Fatalf("walk should not reach %s and see the whole history, got %t and %v", third, reached, seen)
+	}
+}
+
+func TestDeletedRefsAreOnlyDeletedFromTargetWhenPruning(t *testing.T) {
+	g, dir := newTestGitClient(t)
+	defer os.RemoveAll(dir)
+
+	origin := newTestRepo(t, dir, "origin", "repo")
+	h := origin.commit(t, "README", "first")
+	must(t, "failed to create branch", origin.repo.Storer.SetReference(plumbing.NewHashReference("refs/heads/feature", h)))
+	_, err := origin.repo.CreateTag("v1.0", h, nil)
+	must(t, "failed to create tag", err)
+
+	target := newBareTestRepo(t, dir, "target", "repo")
+
+	repo, err := g.CloneOrOpen(origin.url, target.url)
+	must(t, "failed to clone origin", err)
+	_, err = repo.Push()
+	must(t, "failed to push", err)
+
+	must(t, "failed to delete branch", origin.repo.Storer.RemoveReference("refs/heads/feature"))
+	must(t, "failed to delete tag", origin.repo.DeleteTag("v1.0"))
+	must(t, "failed to fetch", repo.Fetch())
+
+	updates, err := repo.Push()
+	must(t, "failed to push without pruning", err)
+	assertUpdates(t, []audit.RefUpdate{}, updates)
+	target.head(t, "feature")
+	if _, err := target.repo.Reference("refs/tags/v1.0", false); err != nil {
+		t.Fatalf("tag should have been kept in target, got %v", err)
+	}
+
+	must(t, "failed to add a target only branch", target.repo.Storer.SetReference(plumbing.NewHashReference("refs/heads/target-only", h)))
+	updates, err = repo.Push()
+	must(t, "failed to push with a target only branch", err)
+	assertUpdates(t, []audit.RefUpdate{}, updates)
+	target.head(t, "target-only")
+
+	repo.settings.pruneTarget = true
+	must(t, "failed to fetch pruning", repo.Fetch())
+	updates, err = repo.Push()
+	must(t, "failed to push deleting", err)
+	assertUpdates(t, []audit.RefUpdate{
+		{Ref: "refs/heads/feature", Old: h.String(), Action: audit.ActionDeleted},
+		{Ref: "refs/heads/target-only", Old: h.String(), Action: audit.ActionDeleted},
+		{Ref: "refs/tags/v1.0", Old: h.String(), Action: audit.ActionDeleted},
+	}, updates)
+	for _, name := range []plumbing.ReferenceName{"refs/heads/feature", "refs/heads/target-only", "refs/tags/v1.0"} {
+		if _, err := target.repo.Reference(name, false); err != plumbing.ErrReferenceNotFound {
+			t.Fatalf("%s should have been deleted from target, got %v", name, err)
+		}
+	}
+
+	updates, err = repo.Push()
+	must(t, "failed to push again", err)
+	assertUpdates(t, []audit.RefUpdate{}, updates)
+}
+
+func TestUpstreamRewritesAreBackedUp(t *testing.T) {
+	g, dir := newTestGitClient(t)
+	defer os.RemoveAll(dir)
+
+	origin := newTestRepo(t, dir, "origin", "repo")
+	first := origin.commit(t, "README", "first")
+	second := origin.commit(t, "README", "second")
+
+	target := newBareTestRepo(t, dir, "target", "repo")
+
+	repo, err := g.CloneOrOpen(origin.url, target.url)
+	must(t, "failed to clone origin", err)
+	_, err = repo.Push()
+	must(t, "failed to push", err)
+
+	w, err := origin.repo.Worktree()
+	must(t, "failed to get worktree", err)
+	must(t, "failed to reset origin", w.Reset(&git.ResetOptions{Commit: first, Mode: git.HardReset}))
+	rewritten := origin.commit(t, "README", "rewritten")
+
+	before, err := repo.localRefs()
+	must(t, "failed to read refs before fetching", err)
+	must(t, "failed to fetch", repo.Fetch())
+	after, err := repo.localRefs()
+	must(t, "failed to read refs after fetching", err)
+
+	rewrites, err := repo.findRewrites(before, after)
+	must(t, "failed to find rewrites", err)
+	if len(rewrites) != 1 || rewrites[0].branch != "master" || rewrites[0].old != second || rewrites[0].new != rewritten {
+		t.Fatalf("expected master to be rewritten from %s to %s, got %#v", second, rewritten, rewrites)
+	}
+
+	at := time.Date(2018, 7, 1, 12, 0, 0, 0, time.UTC)
+	must(t, "failed to back up rewrite", repo.backupRewrite(rewrites[0], at))
+
+	ref, err := target.repo.Reference("refs/mirror-backup/20180701T120000Z/master", false)
+	must(t, "backup ref should exist in target", err)
+	if ref.Hash() != second {
+		t.Fatalf("backup ref should point to %s, got %s", second, ref.Hash())
+	}
+}
+
+func TestRefFilters(t *testing.T) {
+	g, dir := newTestGitClient(t)
+	defer os.RemoveAll(dir)
+
+	origin := newTestRepo(t, dir, "origin", "repo")
+	h := origin.commit(t, "README", "first")
+	must(t, "failed to create branch", origin.repo.Storer.SetReference(plumbing.NewHashReference("refs/heads/feature", h)))
+	_, err := origin.repo.CreateTag("v1.0", h, nil)
+	must(t, "failed to create release tag", err)
+	_, err = origin.repo.CreateTag("nightly", h, nil)
+	must(t, "failed to create nightly tag", err)
+
+	target := newBareTestRepo(t, dir, "target", "repo")
+
+	repo, err := g.CloneOrOpen(origin.url, target.url)
+	must(t, "failed to clone origin", err)
+	repo.settings.refs = []string{"refs/heads/master", "refs/tags/v*"}
+
+	_, err = repo.Push()
+	must(t, "failed to push", err)
+
+	for _, ref := range []plumbing.ReferenceName{"refs/heads/master", "refs/tags/v1.0"} {
+		if _, err := target.repo.Reference(ref, false); err != nil {
+			t.Fatalf("%s should have been pushed: %s", ref, err)
+		}
+	}
+	for _, ref := range []plumbing.ReferenceName{"refs/heads/feature", "refs/tags/nightly"} {
+		if _, err := target.repo.Reference(ref, false); err == nil {
+			t.Fatalf("%s should not have been pushed", ref)
+		}
+	}
+
+	inSync, err := repo.InSync()
+	must(t, "failed to compare origin and target", err)
+	if !inSync {
+		t.Fatalf("target should be in sync with the filtered refs of origin")
+	}
+}
+
+func assertUpdates(t *testing.T, expected, got []audit.RefUpdate) {
+	if !reflect.DeepEqual(expected, got) {
+		t.Fatalf("Expected ref updates %#v, got %#v", expected, got)
+	}
+}
+
+func TestCredentialsAreOnlySentToTheirRemote(t *testing.T) {
+	g, dir := newTestGitClient(t)
+	defer os.RemoveAll(dir)
+
+	originPassword := filepath.Join(dir, "origin-password")
+	must(t, "failed to write origin password", ioutil.WriteFile(originPassword, []byte("origin-secret\n"), 0600))
+
+	origin, err := url.Parse("https://github.com/owner/repo.git")
+	must(t, "failed to parse origin url", err)
+	target, err := url.Parse("https://gitlab.com/owner/repo.git")
+	must(t, "failed to parse target url", err)
+
+	g = g.withCredentials(config.Credentials{Origin: &config.RemoteCredentials{Username: "puller", PasswordFile: originPassword}})
+
+	auth, err := g.authMethod(OriginRemote, origin)
+	must(t, "failed to set up origin auth", err)
+	basic, ok := auth.(*githttp.BasicAuth)
+	if !ok {
+		t.Fatalf("Expected basic auth for origin, got %#v", auth)
+	}
+	assertEquals(t, "puller", basic.Username)
+	assertEquals(t, "origin-secret", basic.Password)
+
+	auth, err = g.authMethod(TargetRemote, target)
+	must(t, "failed to set up target auth", err)
+	if auth != nil {
+		t.Fatalf("Expected the origin credentials not to be sent to the target, got %#v", auth)
+	}
+
+	targetPassword := filepath.Join(dir, "target-password")
+	must(t, "failed to write target password", ioutil.WriteFile(targetPassword, []byte("target-secret"), 0600))
+	g = g.withCredentials(config.Credentials{Target: &config.RemoteCredentials{Username: "pusher", PasswordFile: targetPassword}})
+
+	auth, err = g.authMethod(OriginRemote, origin)
+	must(t, "failed to set up origin auth", err)
+	if auth != nil {
+		t.Fatalf("Expected the target credentials not to be sent to the origin, got %#v", auth)
+	}
+	auth, err = g.authMethod(TargetRemote, target)
+	must(t, "failed to set up target auth", err)
+	if basic, ok := auth.(*githttp.BasicAuth); !ok || basic.Username != "pusher" || basic.Password != "target-secret" {
+		t.Fatalf("Expected the target credentials for target, got %#v", auth)
+	}
+}
+
+func TestFailedPushesAreNotAuditedAsPushed(t *testing.T) {
+	updates := []audit.RefUpdate{
+		{Ref: "refs/heads/diverged", New: "b", Action: audit.ActionSkipped},
+		{Ref: "refs/heads/master", New: "a", Action: audit.ActionPushed},
+		{Ref: "refs/tags/v1", Old: "c", Action: audit.ActionDeleted},
+	}
+	failed(updates)
+	assertUpdates(t, []audit.RefUpdate{
+		{Ref: "refs/heads/diverged", New: "b", Action: audit.ActionSkipped},
+		{Ref: "refs/heads/master", New: "a", Action: audit.ActionFailed},
+		{Ref: "refs/tags/v1", Old: "c", Action: audit.ActionFailed},
+	}, updates)
+}
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// wedgedTimeouts is how many git timeouts a worker can spend on a single
+// update before it is considered wedged. An update fetches origin and target
+// and can retry the push a few times, each of them bound by the git timeout.
+const wedgedTimeouts = 10
+
+// HealthCheck is the result of a single liveness or readiness check
+type HealthCheck struct {
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// HealthStatus is the result of all the liveness or readiness checks
+type HealthStatus struct {
+	Status string                 `json:"status"`
+	Checks map[string]HealthCheck `json:"checks"`
+}
+
+// workerTracker keeps track of when every worker started its current update
+type workerTracker struct {
+	lock      *sync.Mutex
+	busySince []time.Time
+}
+
+func newWorkerTracker(workers int) *workerTracker {
+	if workers < 0 {
+		workers = 0
+	}
+	return &workerTracker{
+		lock:      &sync.Mutex{},
+		busySince: make([]time.Time, workers),
+	}
+}
+
+func (t *workerTracker) start(worker int) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.busySince[worker] = time.Now()
+}
+
+func (t *workerTracker) done(worker int) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.busySince[worker] = time.Time{}
+}
+
+// longestBusy returns how long the longest running update has been running
+func (t *workerTracker) longestBusy(now time.Time) time.Duration {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	longest := time.Duration(0)
+	for _, since := range t.busySince {
+		if !since.IsZero() && now.Sub(since) > longest {
+			longest = now.Sub(since)
+		}
+	}
+	return longest
+}
+
+// HealthzHandler reports whether the process is alive and the workers are not wedged
+func (ws *WebHooksServer) HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	ws.writeHealth(w, map[string]HealthCheck{
+		"workers": ws.checkWorkers(),
+	})
+}
+
+// ReadyzHandler reports whether the server can take requests: the
+// configuration was applied, the queue is not saturated and the repositories
+// path is writable
+func (ws *WebHooksServer) ReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	ws.writeHealth(w, map[string]HealthCheck{
+		"configuration":     ws.checkConfiguration(),
+		"queue":             ws.checkQueue(),
+		"repositories_path": ws.checkRepositoriesPath(),
+	})
+}
+
+func (ws *WebHooksServer) writeHealth(w http.ResponseWriter, checks map[string]HealthCheck) {
+	health := HealthStatus{Status: "ok", Checks: checks}
+	for _, check := range checks {
+		if !check.OK {
+			health.Status = "failing"
+		}
+	}
+
+	if health.Status != "ok" {
+		writeJSON(w, http.StatusServiceUnavailable, health)
+		return
+	}
+	writeJSON(w, http.StatusOK, health)
+}
+
+func (ws *WebHooksServer) checkWorkers() HealthCheck {
+	limit := wedgedTimeouts * time.Duration(ws.opts.GitTimeoutSeconds) * time.Second
+	busy := ws.workers.longestBusy(time.Now())
+	if limit > 0 && busy > limit {
+		return HealthCheck{Detail: fmt.Sprintf("a worker has been busy for %s, more than %s", busy, limit)}
+	}
+	return HealthCheck{OK: true}
+}
+
+func (ws *WebHooksServer) checkConfiguration() HealthCheck {
+	switch {
+	case !ws.isRunning():
+		return HealthCheck{Detail: "server is not running"}
+	case !ws.isReady():
+		return HealthCheck{Detail: "configuration was not applied"}
+	}
+	return HealthCheck{OK: true}
+}
+
+// checkQueue reports the queue as saturated only while updates are blocked
+// waiting to be queued, a full queue is the normal state under load
+func (ws *WebHooksServer) checkQueue() HealthCheck {
+	ws.lock.Lock()
+	blocked := ws.blocked
+	ws.lock.Unlock()
+
+	if blocked > 0 {
+		return HealthCheck{Detail: fmt.Sprintf("queue is saturated, %d updates are waiting to be queued", blocked)}
+	}
+	return HealthCheck{OK: true}
+}
+
+func (ws *WebHooksServer) checkRepositoriesPath() HealthCheck {
+	f, err := ioutil.TempFile(ws.opts.RepositoriesPath, ".readyz")
+	if err != nil {
+		return HealthCheck{Detail: fmt.Sprintf("repositories path is not writable: %s", err)}
+	}
+	f.Close()
+	os.Remove(f.Name())
+
+	return HealthCheck{OK: true}
+}
@@ -0,0 +1,31 @@
+package server
+
+import "sync"
+
+// repositoryLocks serialize the git operations on the local copy of every
+// repository, so it is not set up again while an update is running on it
+type repositoryLocks struct {
+	lock  *sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+func newRepositoryLocks() *repositoryLocks {
+	return &repositoryLocks{
+		lock:  &sync.Mutex{},
+		locks: make(map[string]*sync.Mutex),
+	}
+}
+
+// acquire locks the repository and returns the function that unlocks it
+func (l *repositoryLocks) acquire(key string) func() {
+	l.lock.Lock()
+	lock, ok := l.locks[key]
+	if !ok {
+		lock = &sync.Mutex{}
+		l.locks[key] = lock
+	}
+	l.lock.Unlock()
+
+	lock.Lock()
+	return lock.Unlock
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// poller periodically checks the origin of the repositories that have a poll
+// interval and enqueues an update when there are changes
+type poller struct {
+	lock  *sync.Mutex
+	stops []chan interface{}
+}
+
+func newPoller() *poller {
+	return &poller{
+		lock:  &sync.Mutex{},
+		stops: make([]chan interface{}, 0),
+	}
+}
+
+// Schedule stops all the current polls and starts polling the given
+// repositories, each one with its own interval
+func (p *poller) Schedule(repos map[string]Repository, intervals map[string]time.Duration, enqueue func(Repository)) {
+	p.Stop()
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for key, repo := range repos {
+		interval := intervals[key]
+		if interval <= 0 {
+			continue
+		}
+
+		logrus.Debugf("polling %s every %s", repo.origin, interval)
+		stop := make(chan interface{})
+		p.stops = append(p.stops, stop)
+
+		go func(repo Repository, interval time.Duration) {
+			for {
+				select {
+				case <-stop:
+					return
+				case <-time.After(withJitter(interval)):
+				}
+
+				changed, err := repo.HasChanges()
+				if err != nil {
+					// Enqueue anyway so the failure is handled and accounted as any other update
+					logrus.Warnf("failed to check %s for changes: %s", repo.origin, err)
+				} else if !changed {
+					logrus.Debugf("%s has no changes", repo.origin)
+					continue
+				}
+
+				select {
+				case <-stop:
+					return
+				default:
+					enqueue(repo)
+				}
+			}
+		}(repo, interval)
+	}
+}
+
+// Stop stops all the polls
+func (p *poller) Stop() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for _, stop := range p.stops {
+		close(stop)
+	}
+	p.stops = make([]chan interface{}, 0)
+}
+
+// withJitter spreads the polls up to 10% around the interval to avoid all of
+// them hitting the origin at the same time
+func withJitter(interval time.Duration) time.Duration {
+	jitter := int64(interval) / 5
+	if jitter <= 0 {
+		return interval
+	}
+	return interval - time.Duration(jitter/2) + time.Duration(rand.Int63n(jitter))
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"time"
+
+	"github.com/pborman/uuid"
+	"github.com/robfig/cron"
+	"github.com/sirupsen/logrus"
+	"gitlab.com/yakshaving.art/git-pull-mirror/audit"
+	"gitlab.com/yakshaving.art/git-pull-mirror/metrics"
+)
+
+// reconcileLoop compares the origin and target of every repository following
+// the schedule, enqueuing an update for the ones that drifted. It is a safety
+// net for the webhooks that get lost.
+func (ws *WebHooksServer) reconcileLoop(schedule cron.Schedule) {
+	for {
+		next := schedule.Next(time.Now())
+		logrus.Debugf("next reconciliation at %s", next.Format(time.RFC3339))
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ws.done:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		ws.reconcile()
+	}
+}
+
+// reconcile checks every repository once
+func (ws *WebHooksServer) reconcile() {
+	ws.lock.Lock()
+	repositories := make([]Repository, 0, len(ws.repositories))
+	for _, repo := range ws.repositories {
+		repositories = append(repositories, repo)
+	}
+	ws.lock.Unlock()
+
+	logrus.Infof("reconciling %d repositories", len(repositories))
+	for _, repo := range repositories {
+		if ws.status.isPaused(repo.origin.ToKey()) {
+			logrus.Debugf("not reconciling %s as it is paused", repo.origin)
+			continue
+		}
+
+		inSync, err := repo.InSync()
+		if err != nil {
+			logrus.Warnf("failed to reconcile %s with %s: %s", repo.origin, repo.target, err)
+			continue
+		}
+		metrics.LastReconciled.WithLabelValues(repo.origin.ToPath()).Set(float64(time.Now().Unix()))
+
+		if inSync {
+			continue
+		}
+
+		logrus.Infof("%s drifted from %s, enqueuing an update", repo.target, repo.origin)
+		metrics.DriftDetectedTotal.WithLabelValues(repo.origin.ToPath()).Inc()
+		ws.enqueue(pullTask{id: uuid.NewUUID().String(), source: audit.SourceReconcile, repo: repo})
+	}
+}
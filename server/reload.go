@@ -0,0 +1,221 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+	"gitlab.com/yakshaving.art/git-pull-mirror/config"
+	"gitlab.com/yakshaving.art/git-pull-mirror/metrics"
+)
+
+// Configuration reload results
+const (
+	reloadSuccess = "success"
+	reloadFailure = "failure"
+)
+
+// configWatchDebounce is how long the configuration file has to stay unchanged
+// before it is reloaded, editors and ConfigMap updates change it a few times
+var configWatchDebounce = time.Second
+
+// ConfigStatus is the status of the applied configuration and its reloads
+type ConfigStatus struct {
+	ETag                string     `json:"etag"`
+	Repositories        int        `json:"repositories"`
+	Degraded            int        `json:"degraded"`
+	LastReload          *time.Time `json:"last_reload,omitempty"`
+	LastReloadResult    string     `json:"last_reload_result,omitempty"`
+	LastReloadError     string     `json:"last_reload_error,omitempty"`
+	LastReloadErrorTime *time.Time `json:"last_reload_error_time,omitempty"`
+}
+
+// reloadState keeps track of the configuration reloads
+type reloadState struct {
+	last          time.Time
+	result        string
+	lastError     string
+	lastErrorTime time.Time
+}
+
+// Reload loads the configuration file again and applies it
+func (ws *WebHooksServer) Reload() error {
+	c, err := config.LoadConfiguration(ws.opts.ConfigFile)
+	if err == nil {
+		err = ws.Configure(c)
+	}
+
+	result := reloadSuccess
+	if err != nil {
+		result = reloadFailure
+	}
+	metrics.ConfigReloadTotal.WithLabelValues(result).Inc()
+
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+
+	ws.reloads.last = time.Now()
+	ws.reloads.result = result
+	if err != nil {
+		ws.reloads.lastError = err.Error()
+		ws.reloads.lastErrorTime = ws.reloads.last
+	}
+	return err
+}
+
+// configStatus returns the status of the applied configuration
+func (ws *WebHooksServer) configStatus() ConfigStatus {
+	etag := ws.ETag()
+
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+
+	return ConfigStatus{
+		ETag:                etag,
+		Repositories:        len(ws.config.Repositories),
+		Degraded:            len(ws.degraded),
+		LastReload:          timeOrNil(ws.reloads.last),
+		LastReloadResult:    ws.reloads.result,
+		LastReloadError:     ws.reloads.lastError,
+		LastReloadErrorTime: timeOrNil(ws.reloads.lastErrorTime),
+	}
+}
+
+// watchConfig reloads the configuration when any of its files changes until
+// the server is shut down. It closes ready once it is watching them.
+func (ws *WebHooksServer) watchConfig(ready chan interface{}) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		logrus.Errorf("failed to watch the configuration file, it is only reloaded on SIGHUP: %s", err)
+		return
+	}
+	defer watcher.Close()
+
+	targets := ws.watchConfigFiles(watcher)
+	logrus.Infof("watching %s for changes", ws.opts.ConfigFile)
+	close(ready)
+
+	var debounce <-chan time.Time
+	for {
+		select {
+		case <-ws.done:
+			return
+
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if !ws.isConfigFile(event.Name, targets) && !symlinksChanged(targets) {
+				continue
+			}
+			logrus.Debugf("configuration changed: %s", event)
+			debounce = time.After(configWatchDebounce)
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			logrus.Warnf("failed watching the configuration file: %s", err)
+
+		case <-debounce:
+			debounce = nil
+			logrus.Infof("configuration changed, reloading it")
+			if err := ws.Reload(); err != nil {
+				logrus.Errorf("failed to reload the configuration: %s", err)
+			}
+			targets = ws.watchConfigFiles(watcher)
+		}
+	}
+}
+
+// watchConfigFiles watches the directories of the configuration paths and of
+// every file the configuration was loaded from. Watching the directories
+// instead of the files follows the editors that replace the files and the
+// ConfigMaps that swap the symlinks to them. It returns where the loaded files
+// point to, to notice those swaps.
+func (ws *WebHooksServer) watchConfigFiles(watcher *fsnotify.Watcher) map[string]string {
+	ws.lock.Lock()
+	files := append([]string{}, ws.config.Files...)
+	ws.lock.Unlock()
+
+	dirs := make(map[string]bool)
+	for _, path := range ws.configPaths() {
+		dir := filepath.Dir(path)
+		if info, err := os.Stat(path); err == nil && info.IsDir() {
+			dir = path
+		}
+		if !isGlob(dir) {
+			dirs[dir] = true
+		}
+	}
+
+	targets := make(map[string]string, len(files))
+	for _, file := range files {
+		file = filepath.Clean(file)
+		dirs[filepath.Dir(file)] = true
+		targets[file], _ = filepath.EvalSymlinks(file)
+	}
+
+	for dir := range dirs {
+		if err := watcher.Add(dir); err != nil {
+			logrus.Warnf("failed to watch %s for configuration changes: %s", dir, err)
+		}
+	}
+	return targets
+}
+
+// configPaths returns the configuration path and the includes the
+// configuration was loaded from
+func (ws *WebHooksServer) configPaths() []string {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+
+	paths := []string{filepath.Clean(ws.opts.ConfigFile)}
+	for _, path := range ws.config.Paths {
+		paths = append(paths, filepath.Clean(path))
+	}
+	return paths
+}
+
+// isConfigFile returns whether the file is one the configuration was loaded
+// from, or a *.yml file that one of its directories or globs would load
+func (ws *WebHooksServer) isConfigFile(name string, targets map[string]string) bool {
+	name = filepath.Clean(name)
+	if _, loaded := targets[name]; loaded {
+		return true
+	}
+
+	for _, path := range ws.configPaths() {
+		switch {
+		case name == path:
+			return true
+		case isGlob(path):
+			if matched, _ := filepath.Match(path, name); matched {
+				return true
+			}
+		case filepath.Dir(name) == path && filepath.Ext(name) == ".yml":
+			if info, err := os.Stat(path); err == nil && info.IsDir() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isGlob returns whether the path has any glob meta characters
+func isGlob(path string) bool {
+	return strings.ContainsAny(path, "*?[")
+}
+
+// symlinksChanged returns whether any of the files points somewhere else
+func symlinksChanged(targets map[string]string) bool {
+	for file, target := range targets {
+		if current, _ := filepath.EvalSymlinks(file); current != target {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatchingTheConfiguration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reload_test")
+	must(t, "could not create a temporary dir", err)
+	defer os.RemoveAll(dir)
+
+	defer func(debounce time.Duration) { configWatchDebounce = debounce }(configWatchDebounce)
+	configWatchDebounce = 10 * time.Millisecond
+
+	// Lay out the configuration as a Kubernetes ConfigMap does, the file is a
+	// symlink to a versioned directory through the ..data symlink
+	version := func(name, content string) {
+		must(t, "failed to create version dir", os.Mkdir(filepath.Join(dir, name), 0755))
+		must(t, "failed to write configuration", ioutil.WriteFile(filepath.Join(dir, name, "mirrors.yml"), []byte(content), 0644))
+		must(t, "failed to link version", os.Symlink(name, filepath.Join(dir, "..data_tmp")))
+		must(t, "failed to swap version", os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")))
+	}
+	version("..v1", "repositories: []\n")
+	configFile := filepath.Join(dir, "mirrors.yml")
+	must(t, "failed to link configuration", os.Symlink(filepath.Join("..data", "mirrors.yml"), configFile))
+
+	ws := New(newFakeWebhooksClient(0), WebHooksServerOptions{
+		GitTimeoutSeconds: 10,
+		RepositoriesPath:  filepath.Join(dir, "local"),
+		Concurrency:       1,
+		ConfigFile:        configFile,
+		WatchConfig:       true,
+	})
+	defer close(ws.done)
+
+	must(t, "failed to reload", ws.Reload())
+	status := ws.configStatus()
+	assertEquals(t, reloadSuccess, status.LastReloadResult)
+	assertEquals(t, "", status.LastReloadError)
+
+	ready := make(chan interface{})
+	go ws.watchConfig(ready)
+	select {
+	case <-ready:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the configuration to be watched")
+	}
+
+	version("..v2", "repositories:\n- origin: https://github.com/owner/repo.git\n  target: git@gitlab.com:owner/repo.git\n  on_divergence: bogus\n")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for ws.configStatus().LastReloadResult != reloadFailure {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the changed configuration to be reloaded and fail")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	status = ws.configStatus()
+	if status.LastReloadError == "" || status.LastReloadErrorTime == nil {
+		t.Fatalf("Expected the reload error to be recorded, got %#v", status)
+	}
+	if status.Repositories != 0 {
+		t.Fatalf("Expected the failed reload to keep the empty configuration, got %d repositories", status.Repositories)
+	}
+}
+
+func TestOnlyConfigurationFilesAreWatched(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reload_test")
+	must(t, "could not create a temporary dir", err)
+	defer os.RemoveAll(dir)
+
+	for _, d := range []string{"conf.d", "extra"} {
+		must(t, "failed to create dir", os.Mkdir(filepath.Join(dir, d), 0755))
+	}
+	must(t, "failed to write configuration", ioutil.WriteFile(filepath.Join(dir, "conf.d", "main.yml"), []byte("include:\n- ../extra/*.yml\nrepositories: []\n"), 0644))
+	must(t, "failed to write include", ioutil.WriteFile(filepath.Join(dir, "extra", "team.yml"), []byte("repositories: []\n"), 0644))
+
+	ws := New(newFakeWebhooksClient(0), WebHooksServerOptions{
+		GitTimeoutSeconds: 10,
+		RepositoriesPath:  filepath.Join(dir, "local"),
+		Concurrency:       1,
+		ConfigFile:        filepath.Join(dir, "conf.d"),
+	})
+	must(t, "failed to reload", ws.Reload())
+
+	tt := []struct {
+		file     string
+		expected bool
+	}{
+		{"conf.d/main.yml", true},
+		{"conf.d/new.yml", true},
+		{"conf.d/notes.txt", false},
+		{"extra/team.yml", true},
+		{"extra/other.yml", true},
+		{"extra/other.yaml", false},
+		{"unrelated.yml", false},
+		{"local/repo.yml", false},
+	}
+	for _, tc := range tt {
+		t.Run(tc.file, func(t *testing.T) {
+			if got := ws.isConfigFile(filepath.Join(dir, tc.file), map[string]string{}); got != tc.expected {
+				t.Fatalf("Expected %s to be a configuration file: %t, got %t", tc.file, tc.expected, got)
+			}
+		})
+	}
+}
@@ -1,40 +1,82 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/url"
+	"os"
+	"reflect"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/pborman/uuid"
+	"github.com/robfig/cron"
 	"github.com/sirupsen/logrus"
+	"gitlab.com/yakshaving.art/git-pull-mirror/audit"
 	"gitlab.com/yakshaving.art/git-pull-mirror/config"
 	"gitlab.com/yakshaving.art/git-pull-mirror/metrics"
 	"gitlab.com/yakshaving.art/git-pull-mirror/webhooks"
+	"gopkg.in/src-d/go-git.v4/plumbing"
 )
 
 // WebHooksServer is the server that will listen for webhooks calls and handle them
 type WebHooksServer struct {
+	// wg tracks the queued and running updates
 	wg   *sync.WaitGroup
 	lock *sync.Mutex
 
-	mux *http.ServeMux
+	// queueLock guards running, stopped and the sends to tasksCh, so the
+	// channel is never closed while an update is being enqueued
+	queueLock *sync.RWMutex
+	stopped   bool
+
+	// configLock serializes the changes to the configuration
+	configLock *sync.Mutex
+
+	mux     *http.ServeMux
+	servers []*http.Server
+
+	// ctx is cancelled to abort the git operations when shutting down
+	ctx    context.Context
+	cancel context.CancelFunc
+	// cancelled are the repositories whose updates were cancelled
+	cancelled map[string]bool
+	// degraded are the configured repositories that failed to be set up
+	degraded map[string]*degradedRepository
+	// reloads are the results of reloading the configuration file
+	reloads reloadState
 
 	WebHooksClient webhooks.Client
+	webhooks       *webhooksReconciler
+	poller         *poller
+	status         *statusStore
+	workers        *workerTracker
+	repoLocks      *repositoryLocks
 	opts           WebHooksServerOptions
 	config         config.Config
 	repositories   map[string]Repository
 	running        bool
 	ready          bool
 	callbackPath   string
+	// blocked is how many enqueues are waiting for room in the queue
+	blocked int
 
 	tasksCh chan pullTask
+	done    chan interface{}
 }
 
 type pullTask struct {
-	id   string
-	repo Repository
+	id     string
+	source string
+	repo   Repository
+
+	// finished is notified when the task is done, if set
+	finished *sync.WaitGroup
 }
 
 // WebHooksServerOptions holds server configuration options
@@ -43,16 +85,101 @@ type WebHooksServerOptions struct {
 	RepositoriesPath  string
 	SSHPrivateKey     string
 	Concurrency       int
+	// ConfigConcurrency is how many repositories are cloned or fetched at the
+	// same time when applying a configuration
+	ConfigConcurrency int
+	// StrictConfig rejects the whole configuration when a repository fails to
+	// be set up, instead of applying the rest and retrying it in the background
+	StrictConfig bool
+
+	WebhooksVerifySeconds uint64
+	PollIntervalSeconds   uint64
+	ReconcileSchedule     string
+
+	// Allowlist restricts the addresses webhooks are accepted from, they are
+	// accepted from anywhere when it is not set
+	Allowlist *Allowlist
+	// TLS is the tls configuration of the webhooks listener, it serves plain
+	// http when it is not set
+	TLS *tls.Config
+	// ReadTimeoutSeconds, WriteTimeoutSeconds and IdleTimeoutSeconds bound the
+	// http connections of the listeners, 0 means no timeout. The write timeout
+	// only applies to the main listener when the admin one is apart
+	ReadTimeoutSeconds  uint64
+	WriteTimeoutSeconds uint64
+	IdleTimeoutSeconds  uint64
+
+	// AuditLog records every repository update, an in memory one is used when not set
+	AuditLog *audit.Log
+	// AdminAddress is where the admin listener serves the metrics, pprof and
+	// the admin api, they are served by the main listener when it is not set
+	AdminAddress string
+	// AdminTLS is the tls configuration of the admin listener, if any
+	AdminTLS *tls.Config
+
+	// APIAccess controls the access to the admin api, the endpoints that
+	// change state are disabled unless there is an operator
+	APIAccess AccessRules
+	// MetricsAccess controls the access to the metrics
+	MetricsAccess AccessRules
+	// DashboardAccess controls the access to the dashboard, apart from the
+	// admin api so browsers can load it without sending a bearer token
+	DashboardAccess AccessRules
+	// PprofAccess controls the access to the pprof endpoints in the admin listener
+	PprofAccess AccessRules
+	// ConfigFile is where the configuration changes made through the api are
+	// written, they are only kept in memory when it is not set
+	ConfigFile string
+	// WatchConfig reloads the configuration file when it changes
+	WatchConfig bool
+	// QueueFile is where the repositories whose updates were cancelled when
+	// shutting down are written, to update them again on the next start
+	QueueFile string
 }
 
+// Errors returned when changing the configuration
+var (
+	errConfigChanged     = fmt.Errorf("configuration changed, reload it and try again")
+	errUnknownRepository = fmt.Errorf("unknown repository")
+	errSplitConfig       = fmt.Errorf("configuration is split in several files, change them instead")
+)
+
+// ErrShutdownTimeout is returned when the updates didn't finish before the
+// shutdown timeout and had to be cancelled
+var ErrShutdownTimeout = fmt.Errorf("updates didn't finish in time and were cancelled")
+
+// defaultConfigConcurrency is used when the config concurrency is not set
+const defaultConfigConcurrency = 4
+
 // New returns a new unconfigured webhooks server
 func New(client webhooks.Client, opts WebHooksServerOptions) *WebHooksServer {
+	if opts.AuditLog == nil {
+		opts.AuditLog, _ = audit.New("", audit.DefaultRecords)
+	}
+	if opts.ConfigConcurrency <= 0 {
+		opts.ConfigConcurrency = defaultConfigConcurrency
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
 	return &WebHooksServer{
 		wg:             &sync.WaitGroup{},
 		lock:           &sync.Mutex{},
+		queueLock:      &sync.RWMutex{},
+		ctx:            ctx,
+		cancel:         cancel,
+		cancelled:      make(map[string]bool),
+		degraded:       make(map[string]*degradedRepository),
+		configLock:     &sync.Mutex{},
 		opts:           opts,
 		WebHooksClient: client,
+		webhooks:       newWebhooksReconciler(client, time.Duration(opts.WebhooksVerifySeconds)*time.Second),
+		poller:         newPoller(),
+		status:         newStatusStore(),
+		workers:        newWorkerTracker(opts.Concurrency),
+		repoLocks:      newRepositoryLocks(),
 		tasksCh:        make(chan pullTask, opts.Concurrency),
+		done:           make(chan interface{}),
 	}
 }
 
@@ -60,66 +187,506 @@ func New(client webhooks.Client, opts WebHooksServerOptions) *WebHooksServer {
 func (ws *WebHooksServer) Configure(c config.Config) error {
 	logrus.Debug("loading configuration")
 
-	g := newGitClient(ws.opts)
+	ws.configLock.Lock()
+	defer ws.configLock.Unlock()
+
+	// Unchanged repositories keep going as they are, including their running
+	// updates, only the added and changed ones are set up
+	ws.lock.Lock()
+	diff := diffConfigs(ws.config, c)
+	kept := make(map[string]Repository, len(diff.unchanged))
+	previous := make(map[string]Repository, len(diff.changed))
+	degraded := make(map[string]*degradedRepository)
+	for _, r := range diff.unchanged {
+		key := r.OriginURL.ToKey()
+		if repo, ok := ws.repositories[key]; ok {
+			kept[key] = repo
+		}
+		if d, ok := ws.degraded[key]; ok {
+			degraded[key] = d
+		}
+	}
+	for _, r := range diff.changed {
+		if repo, ok := ws.repositories[r.OriginURL.ToKey()]; ok {
+			previous[r.OriginURL.ToKey()] = repo
+		}
+	}
+	ws.lock.Unlock()
+
+	logrus.Infof("configuration changes: %d added, %d removed, %d changed, %d unchanged",
+		len(diff.added), len(diff.removed), len(diff.changed), len(diff.unchanged))
+
+	touched := append(append([]config.RepositoryConfig{}, diff.added...), diff.changed...)
+	metrics.ReposConfigured.Set(float64(len(kept)))
+	repositories, failed := ws.setupRepositories(newGitClient(ws.ctx, ws.opts), touched)
+	for _, err := range failed {
+		logrus.Errorf("failed to clone or open repository %s", err)
+	}
+	if len(failed) > 0 && ws.opts.StrictConfig {
+		return fmt.Errorf("failed to load configuration")
+	}
+	for key, repo := range kept {
+		repositories[key] = repo
+	}
+	// The changed repositories that fail to be set up again keep running as
+	// they were until the retries apply their new configuration
+	for key, repo := range previous {
+		if _, ok := failed[key]; ok {
+			repositories[key] = repo
+		}
+	}
+
+	ws.lock.Lock()
+	ws.config = c
+	ws.repositories = repositories
+	resumed := ws.status.configure(c)
+	for _, r := range touched {
+		key := r.OriginURL.ToKey()
+		err, ok := failed[key]
+		if !ok {
+			ws.status.recovered(key)
+			continue
+		}
+		d := newDegradedRepository(r)
+		degraded[key] = d
+		ws.status.failed(key, err)
+		ws.status.degraded(key, d.nextAttempt)
+	}
+	ws.degraded = degraded
+	ws.ready = true
+	metrics.ServerIsUp.Set(1)
+
+	metrics.LastSuccessfulConfigApply.Set(float64(time.Now().Unix()))
+	ws.lock.Unlock()
+
+	ws.schedulePolls()
+	ws.resume(resumed)
+
+	for _, r := range diff.removed {
+		ws.teardownRepository(r)
+	}
+
+	if len(degraded) > 0 {
+		logrus.Warnf("configuration loaded with %d degraded repositories, retrying them in the background", len(degraded))
+		return nil
+	}
+	logrus.Infof("configuration loaded successfully")
+	return nil
+}
 
-	repositories := make(map[string]Repository, len(c.Repositories))
-	errors := make(chan error, len(c.Repositories))
+// progressEvery is how many repositories are set up between progress logs
+const progressEvery = 10
 
+// setupResult is the outcome of setting up a single repository
+type setupResult struct {
+	key  string
+	repo Repository
+	err  error
+}
+
+// setupRepositories sets up the repositories using at most ConfigConcurrency
+// workers, so booting with hundreds of them doesn't exhaust the memory or the
+// file descriptors. It returns the ones that were set up and the errors of the
+// rest by key.
+func (ws *WebHooksServer) setupRepositories(g gitClient, repos []config.RepositoryConfig) (map[string]Repository, map[string]error) {
+	total := len(repos)
+	metrics.ReposPending.Set(float64(total))
+
+	pending := make(chan config.RepositoryConfig)
+	results := make(chan setupResult)
+
+	go func() {
+		defer close(pending)
+		for _, r := range repos {
+			pending <- r
+		}
+	}()
+
+	workers := ws.opts.ConfigConcurrency
+	if workers > total {
+		workers = total
+	}
 	wg := &sync.WaitGroup{}
-	for _, r := range c.Repositories {
+	for i := 0; i < workers; i++ {
 		wg.Add(1)
-		go func(r config.RepositoryConfig) {
+		go func() {
 			defer wg.Done()
-
-			repo, err := g.CloneOrOpen(r.OriginURL, r.TargetURL)
-			if err != nil {
-				errors <- fmt.Errorf("failed to clone or open %s: %s", r.OriginURL, err)
-				metrics.RepoIsUp.WithLabelValues(r.OriginURL.ToPath()).Set(0)
-				return
+			for r := range pending {
+				repo, err := ws.setupRepository(g, r)
+				results <- setupResult{key: r.OriginURL.ToKey(), repo: repo, err: err}
 			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
 
-			if err = repo.Fetch(); err != nil {
-				errors <- fmt.Errorf("failed to fetch %s: %s", r.OriginURL, err)
-				metrics.RepoIsUp.WithLabelValues(r.OriginURL.ToPath()).Set(0)
-				return
-			}
+	repositories := make(map[string]Repository, total)
+	errors := make(map[string]error)
+	done := 0
+	for result := range results {
+		done++
+		metrics.ReposPending.Dec()
+		if result.err != nil {
+			errors[result.key] = result.err
+		} else {
+			repositories[result.key] = result.repo
+			metrics.ReposConfigured.Inc()
+		}
 
-			if err = ws.WebHooksClient.RegisterWebhook(r.OriginURL); err != nil {
-				// We're skipping these errors on purporse to allow the server to boot up even if webhooks fail
-				logrus.Warnf("failed to register webhooks for %s: %s", r.OriginURL, err)
-			}
+		if done%progressEvery == 0 || done == total {
+			logrus.Infof("set up %d/%d repositories, %d failed", done, total, len(errors))
+		}
+	}
+	return repositories, errors
+}
+
+// setupRepository clones or opens the repository, fetches it and registers its
+// webhook, waiting for the update running on its local copy, if any
+func (ws *WebHooksServer) setupRepository(g gitClient, r config.RepositoryConfig) (Repository, error) {
+	defer ws.repoLocks.acquire(r.OriginURL.ToKey())()
 
-			repositories[r.OriginURL.ToKey()] = repo
-		}(r)
+	repo, err := g.withCredentials(r.Auth).CloneOrOpen(r.OriginURL, r.TargetURL)
+	if err != nil {
+		ws.status.failed(r.OriginURL.ToKey(), err)
+		metrics.RepoIsUp.WithLabelValues(r.OriginURL.ToPath()).Set(0)
+		return repo, fmt.Errorf("failed to clone or open %s: %s", r.OriginURL, err)
+	}
+	repo.settings = repositorySettings{
+		onDivergence:   r.OnDivergence,
+		backupRewrites: r.BackupRewrites,
+		pruneTarget:    r.PruneTarget,
+		refs:           r.RefFilters,
 	}
-	wg.Wait()
 
-	close(errors)
+	if r.Paused {
+		logrus.Infof("repository %s is paused, not fetching it", r.OriginURL)
+	} else if err = repo.Fetch(); err != nil {
+		ws.status.failed(r.OriginURL.ToKey(), err)
+		metrics.RepoIsUp.WithLabelValues(r.OriginURL.ToPath()).Set(0)
+		return repo, fmt.Errorf("failed to fetch %s: %s", r.OriginURL, err)
+	}
 
-	failed := false
-	for err := range errors {
-		failed = true
-		logrus.Errorf("failed to clone or open repository %s", err)
+	if ws.webhooksEnabled() {
+		// Failed registrations are retried in the background to allow the server to boot up even if webhooks fail
+		ws.webhooks.Register(r.OriginURL)
 	}
+	return repo, nil
+}
 
-	if failed {
-		return fmt.Errorf("failed to load configuration")
+// teardownRepository unregisters the webhook of a repository that is not
+// configured anymore and forgets its metrics
+func (ws *WebHooksServer) teardownRepository(r config.RepositoryConfig) {
+	logrus.Infof("repository %s was removed from the configuration, unregistering webhook", r.OriginURL)
+	ws.webhooks.Unregister(r.OriginURL)
+	metrics.RepoIsUp.DeleteLabelValues(r.OriginURL.ToPath())
+}
+
+// schedulePolls starts polling the configured repositories that have a poll
+// interval, leaving out the paused ones as reconcile does
+func (ws *WebHooksServer) schedulePolls() {
+	ws.lock.Lock()
+	repositories := make(map[string]Repository, len(ws.repositories))
+	for key, repo := range ws.repositories {
+		repositories[key] = repo
+	}
+	intervals := make(map[string]time.Duration, len(ws.config.Repositories))
+	for _, r := range ws.config.Repositories {
+		if r.Paused {
+			logrus.Debugf("not polling %s as it is paused", r.OriginURL)
+			continue
+		}
+		intervals[r.OriginURL.ToKey()] = r.PollInterval
+		if r.PollInterval == 0 {
+			intervals[r.OriginURL.ToKey()] = time.Duration(ws.opts.PollIntervalSeconds) * time.Second
+		}
 	}
+	ws.lock.Unlock()
+
+	ws.poller.Schedule(repositories, intervals, func(repo Repository) {
+		ws.enqueue(pullTask{id: uuid.NewUUID().String(), source: audit.SourcePoll, repo: repo})
+	})
+}
+
+// PutRepository adds a repository to the configuration or updates it, applying
+// it right away without touching the rest of the repositories. The resulting
+// configuration is written to the configuration file, if any. It returns
+// whether the repository was added.
+func (ws *WebHooksServer) PutRepository(r config.RepositoryConfig, etag string) (bool, error) {
+	ws.configLock.Lock()
+	defer ws.configLock.Unlock()
 
 	ws.lock.Lock()
-	defer ws.lock.Unlock()
+	current := ws.config
+	ws.lock.Unlock()
 
+	if etag != "" && etag != current.ETag() {
+		return false, errConfigChanged
+	}
+
+	key := r.OriginURL.ToKey()
+	c := config.Config{Defaults: current.Defaults, Include: current.Include, Files: current.Files, Paths: current.Paths, Repositories: make([]config.RepositoryConfig, 0, len(current.Repositories)+1)}
+	created := true
+	for _, existing := range current.Repositories {
+		if existing.OriginURL.ToKey() == key {
+			r.File, r.Line = existing.File, existing.Line
+			existing = r
+			created = false
+		}
+		c.Repositories = append(c.Repositories, existing)
+	}
+	if created {
+		c.Repositories = append(c.Repositories, r)
+	}
+
+	// Fail before cloning and registering the webhook when the configuration
+	// can't be written back at all
+	if _, err := ws.configFileFor(c); err != nil {
+		return created, err
+	}
+
+	g := newGitClient(ws.ctx, ws.opts)
+	repo, err := ws.setupRepository(g, r)
+	if err != nil {
+		return created, err
+	}
+
+	if err = ws.persist(c); err != nil {
+		ws.undoSetup(g, r, created)
+		return created, err
+	}
+
+	ws.lock.Lock()
 	ws.config = c
-	ws.repositories = repositories
-	ws.ready = true
-	metrics.ServerIsUp.Set(1)
+	ws.repositories[key] = repo
+	delete(ws.degraded, key)
+	resumed := ws.status.configure(c)
+	ws.status.recovered(key)
+	metrics.ReposConfigured.Set(float64(len(ws.repositories)))
+	ws.lock.Unlock()
 
-	metrics.LastSuccessfulConfigApply.Set(float64(time.Now().Unix()))
+	ws.schedulePolls()
+	ws.resume(resumed)
 
-	logrus.Infof("configuration loaded successfully")
+	logrus.Infof("repository %s was put in the configuration", r.OriginURL)
+	return created, nil
+}
+
+// DeleteRepository removes a repository from the configuration, unregistering
+// its webhook. The resulting configuration is written to the configuration
+// file, if any.
+func (ws *WebHooksServer) DeleteRepository(key, etag string) error {
+	ws.configLock.Lock()
+	defer ws.configLock.Unlock()
+
+	ws.lock.Lock()
+	current := ws.config
+	ws.lock.Unlock()
+
+	if etag != "" && etag != current.ETag() {
+		return errConfigChanged
+	}
+
+	c := config.Config{Defaults: current.Defaults, Include: current.Include, Files: current.Files, Paths: current.Paths, Repositories: make([]config.RepositoryConfig, 0, len(current.Repositories))}
+	var removed *config.RepositoryConfig
+	for i, existing := range current.Repositories {
+		if existing.OriginURL.ToKey() == key {
+			removed = &current.Repositories[i]
+			continue
+		}
+		c.Repositories = append(c.Repositories, existing)
+	}
+	if removed == nil {
+		return errUnknownRepository
+	}
+
+	if err := ws.persist(c); err != nil {
+		return err
+	}
+
+	ws.lock.Lock()
+	ws.config = c
+	delete(ws.repositories, key)
+	delete(ws.degraded, key)
+	ws.status.configure(c)
+	metrics.ReposConfigured.Set(float64(len(ws.repositories)))
+	ws.lock.Unlock()
+
+	ws.schedulePolls()
+	ws.teardownRepository(*removed)
 	return nil
 }
 
+// SetPaused pauses or resumes a repository, writing the resulting
+// configuration to the configuration file, if any. Resuming a repository runs
+// a single update to catch up with the changes made while it was paused.
+func (ws *WebHooksServer) SetPaused(key string, paused bool, etag string) error {
+	ws.configLock.Lock()
+	defer ws.configLock.Unlock()
+
+	ws.lock.Lock()
+	current := ws.config
+	ws.lock.Unlock()
+
+	if etag != "" && etag != current.ETag() {
+		return errConfigChanged
+	}
+
+	c := config.Config{Defaults: current.Defaults, Include: current.Include, Files: current.Files, Paths: current.Paths, Repositories: make([]config.RepositoryConfig, 0, len(current.Repositories))}
+	found := false
+	for _, existing := range current.Repositories {
+		if existing.OriginURL.ToKey() == key {
+			existing.Paused = paused
+			found = true
+		}
+		c.Repositories = append(c.Repositories, existing)
+	}
+	if !found {
+		return errUnknownRepository
+	}
+
+	if err := ws.persist(c); err != nil {
+		return err
+	}
+
+	ws.lock.Lock()
+	ws.config = c
+	resumed := ws.status.configure(c)
+	ws.lock.Unlock()
+
+	if paused {
+		logrus.Infof("repository %s paused", key)
+	}
+	ws.schedulePolls()
+	ws.resume(resumed)
+	return nil
+}
+
+// resume enqueues a catch up update for the repositories that were resumed
+func (ws *WebHooksServer) resume(keys []string) {
+	for _, key := range keys {
+		ws.lock.Lock()
+		repo, ok := ws.repositories[key]
+		ws.lock.Unlock()
+		if !ok {
+			continue
+		}
+
+		logrus.Infof("repository %s resumed, enqueuing an update to catch up", key)
+		ws.enqueue(pullTask{id: uuid.NewUUID().String(), source: audit.SourceResume, repo: repo})
+	}
+}
+
+// persist writes the configuration to the configuration file, if any. When it
+// was loaded from a directory or a glob with a single file, it is written to
+// that file, and it can't be changed when it is split in several files.
+func (ws *WebHooksServer) persist(c config.Config) error {
+	filename, err := ws.configFileFor(c)
+	if err != nil || filename == "" {
+		return err
+	}
+	return config.WriteConfiguration(filename, c)
+}
+
+// configFileFor returns the file the configuration is written to, none when
+// it is only kept in memory, and errSplitConfig when it is split in several files
+func (ws *WebHooksServer) configFileFor(c config.Config) (string, error) {
+	if ws.opts.ConfigFile == "" {
+		return "", nil
+	}
+	switch len(c.Files) {
+	case 0:
+		return ws.opts.ConfigFile, nil
+	case 1:
+		return c.Files[0], nil
+	default:
+		return "", errSplitConfig
+	}
+}
+
+// undoSetup reverts setting up a repository whose configuration could not be
+// written: an added one is torn down and its clone removed, and a changed one
+// gets the remotes of the running one back
+func (ws *WebHooksServer) undoSetup(g gitClient, r config.RepositoryConfig, created bool) {
+	if !created {
+		ws.lock.Lock()
+		previous, ok := ws.repositories[r.OriginURL.ToKey()]
+		ws.lock.Unlock()
+		if !ok {
+			return
+		}
+		if err := previous.updateRemotes(); err != nil {
+			logrus.Errorf("failed to restore the remotes of %s: %s", r.OriginURL, err)
+		}
+		return
+	}
+
+	ws.teardownRepository(r)
+	if err := os.RemoveAll(g.pathFor(r.OriginURL)); err != nil {
+		logrus.Errorf("failed to remove the clone of %s: %s", r.OriginURL, err)
+	}
+}
+
+// configDefaults returns the defaults of the configuration, used by the
+// repositories put through the api
+func (ws *WebHooksServer) configDefaults() config.Defaults {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+
+	return ws.config.Defaults
+}
+
+// ETag returns the identifier of the current configuration
+func (ws *WebHooksServer) ETag() string {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+
+	return ws.config.ETag()
+}
+
+// configDiff is how a configuration changes from the one that is applied
+type configDiff struct {
+	added     []config.RepositoryConfig
+	removed   []config.RepositoryConfig
+	changed   []config.RepositoryConfig
+	unchanged []config.RepositoryConfig
+}
+
+// diffConfigs compares the repositories of the previous configuration with the
+// current ones by origin key, any difference in a repository makes it changed
+func diffConfigs(previous, current config.Config) configDiff {
+	diff := configDiff{}
+
+	existing := make(map[string]config.RepositoryConfig, len(previous.Repositories))
+	for _, r := range previous.Repositories {
+		existing[r.OriginURL.ToKey()] = r
+	}
+
+	keys := make(map[string]bool, len(current.Repositories))
+	for _, r := range current.Repositories {
+		keys[r.OriginURL.ToKey()] = true
+		p, ok := existing[r.OriginURL.ToKey()]
+		// Moving a repository around the files doesn't change it
+		p.File, p.Line = r.File, r.Line
+		switch {
+		case !ok:
+			diff.added = append(diff.added, r)
+		case !reflect.DeepEqual(p, r):
+			diff.changed = append(diff.changed, r)
+		default:
+			diff.unchanged = append(diff.unchanged, r)
+		}
+	}
+
+	for _, r := range previous.Repositories {
+		if !keys[r.OriginURL.ToKey()] {
+			diff.removed = append(diff.removed, r)
+		}
+	}
+	return diff
+}
+
 // Run starts the execution of the server, forever
 func (ws *WebHooksServer) Run(address string, c config.Config, ready chan interface{}) {
 	logrus.Debugf("Booting up server")
@@ -127,81 +694,293 @@ func (ws *WebHooksServer) Run(address string, c config.Config, ready chan interf
 		logrus.Warnf("failed to configure server propertly: %s", err)
 	}
 
-	callback, err := url.ParseRequestURI(ws.WebHooksClient.GetCallbackURL())
-	if err != nil {
-		logrus.Fatalf("could not parse callback url %s: %s", ws.WebHooksClient.GetCallbackURL(), err)
+	if ws.webhooksEnabled() {
+		callback, err := url.ParseRequestURI(ws.WebHooksClient.GetCallbackURL())
+		if err != nil {
+			logrus.Fatalf("could not parse callback url %s: %s", ws.WebHooksClient.GetCallbackURL(), err)
+		}
+		ws.callbackPath = callback.Path
 	}
-	ws.callbackPath = callback.Path
+
+	ws.queueLock.Lock()
+	ws.running = true
+	ws.queueLock.Unlock()
 
 	// Launch as many worker goroutines as concurrency was declared
 	for i := 0; i < ws.opts.Concurrency; i++ {
-		go func() {
+		go func(worker int) {
 			for task := range ws.tasksCh {
-				ws.updateRepository(task.id, task.repo)
+				ws.workers.start(worker)
+				ws.updateRepository(task)
+				ws.workers.done(worker)
 			}
-		}()
+		}(i)
+	}
+	go ws.restoreQueue()
+
+	go ws.webhooks.Run(ws.done)
+	go ws.retryDegradedLoop()
+	if ws.opts.WatchConfig && ws.opts.ConfigFile != "" {
+		go ws.watchConfig(make(chan interface{}))
+	}
+	if ws.opts.Allowlist != nil {
+		go ws.opts.Allowlist.refreshLoop(ws.done)
+	}
+
+	if ws.opts.ReconcileSchedule != "" {
+		schedule, err := cron.ParseStandard(ws.opts.ReconcileSchedule)
+		if err != nil {
+			logrus.Fatalf("could not parse reconcile schedule %s: %s", ws.opts.ReconcileSchedule, err)
+		}
+		go ws.reconcileLoop(schedule)
 	}
 
 	ws.mux = http.NewServeMux()
-	ws.mux.HandleFunc(ws.callbackPath, ws.WebHookHandler)
-	metrics.Register("/metrics", ws.mux)
+	if ws.webhooksEnabled() {
+		ws.mux.HandleFunc(ws.callbackPath, ws.WebHookHandler)
+	}
+	ws.mux.HandleFunc("/healthz", ws.HealthzHandler)
+	ws.mux.HandleFunc("/readyz", ws.ReadyzHandler)
 
-	logrus.Infof("starting listener on %s", address)
-	ws.running = true
+	adminMux := ws.mux
+	if ws.opts.AdminAddress != "" {
+		adminMux = http.NewServeMux()
+		registerPprof(adminMux, ws.opts.PprofAccess)
+	}
+	ws.registerAdmin(adminMux)
+
+	if ws.opts.AdminAddress != "" {
+		go ws.serveAdmin(adminMux)
+	}
+
+	// The write timeout would cut off pprof profiles and syncs waiting for
+	// their updates when the admin endpoints are served here too
+	server := ws.newHTTPServer(address, ws.mux, ws.opts.TLS, ws.opts.AdminAddress != "")
+	ws.addServer(server)
 
+	logrus.Infof("starting listener on %s", address)
 	ready <- true
-	if err := http.ListenAndServe(address, ws.mux); err != nil {
+	if err := listenAndServe(server); err != nil && err != http.ErrServerClosed {
 		logrus.Fatalf("failed to start http server: %s", err)
 	}
 }
 
-// Shutdown performs a graceful shutdown of the webhooks server
-func (ws *WebHooksServer) Shutdown() {
-	ws.running = false
+// addServer keeps track of an http server to shut it down
+func (ws *WebHooksServer) addServer(server *http.Server) {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+
+	ws.servers = append(ws.servers, server)
+}
+
+// registerAdmin registers the metrics and the admin api
+func (ws *WebHooksServer) registerAdmin(mux *http.ServeMux) {
+	metricsMux := http.NewServeMux()
+	metrics.Register("/metrics", metricsMux)
+	mux.Handle("/metrics", withAccess(ws.opts.MetricsAccess, RoleReadOnly, metricsMux))
+
+	mux.HandleFunc("/api/v1/audit", ws.AuditHandler)
+	mux.HandleFunc("/api/v1/config", ws.ConfigHandler)
+	mux.HandleFunc("/api/v1/repos", ws.RepositoriesHandler)
+	mux.HandleFunc("/api/v1/repos/", ws.RepositoryHandler)
+	mux.HandleFunc("/api/v1/sync", ws.SyncAllHandler)
+	mux.HandleFunc("/dashboard", ws.DashboardHandler)
+}
 
-	// Wait for all the ongoing requests to finish
-	ws.wg.Wait()
+func (ws *WebHooksServer) serveAdmin(mux *http.ServeMux) {
+	// pprof profiles and syncs waiting for their updates take longer than any
+	// sensible write timeout
+	server := ws.newHTTPServer(ws.opts.AdminAddress, mux, ws.opts.AdminTLS, false)
+	ws.addServer(server)
 
-	// Close the channel so we don't leak goroutines
+	logrus.Infof("starting admin listener on %s", ws.opts.AdminAddress)
+	if err := listenAndServe(server); err != nil && err != http.ErrServerClosed {
+		logrus.Fatalf("failed to start admin http server: %s", err)
+	}
+}
+
+// Shutdown performs a graceful shutdown of the webhooks server: it stops
+// accepting connections and updates, then waits for the queued and running
+// updates to finish. Past the timeout the updates are cancelled, written to
+// the queue file if any, and ErrShutdownTimeout is returned.
+func (ws *WebHooksServer) Shutdown(timeout time.Duration) error {
+	ws.queueLock.Lock()
+	if ws.stopped {
+		ws.queueLock.Unlock()
+		return nil
+	}
+	ws.running = false
+	ws.stopped = true
+	// Nobody can enqueue anymore, the workers stop once the queue is drained
 	close(ws.tasksCh)
+	ws.queueLock.Unlock()
+
+	ws.poller.Stop()
+	close(ws.done)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	ws.lock.Lock()
+	servers := ws.servers
+	ws.lock.Unlock()
+
+	// Requests waiting for their updates are answered as the updates finish
+	// or get cancelled, so the servers are shut down in the background
+	serversDone := make(chan interface{})
+	go func() {
+		defer close(serversDone)
+		for _, server := range servers {
+			if err := server.Shutdown(ctx); err != nil {
+				logrus.Warnf("failed to shut down listener on %s gracefully: %s", server.Addr, err)
+			}
+		}
+	}()
+
+	updatesDone := make(chan interface{})
+	go func() {
+		ws.wg.Wait()
+		close(updatesDone)
+	}()
+
+	var err error
+	select {
+	case <-updatesDone:
+	case <-ctx.Done():
+		logrus.Warnf("updates didn't finish in %s, cancelling them", timeout)
+		ws.cancel()
+		<-updatesDone
+		ws.persistQueue()
+		err = ErrShutdownTimeout
+	}
+	<-serversDone
+	ws.cancel()
 
 	logrus.Infof("server stopped")
+	return err
+}
+
+// persistQueue writes the repositories whose updates were cancelled to the
+// queue file, if any
+func (ws *WebHooksServer) persistQueue() {
+	ws.lock.Lock()
+	keys := make([]string, 0, len(ws.cancelled))
+	for key := range ws.cancelled {
+		keys = append(keys, key)
+	}
+	ws.lock.Unlock()
+
+	if ws.opts.QueueFile == "" {
+		if len(keys) > 0 {
+			logrus.Warnf("dropped the cancelled updates of %d repositories, they will be updated on their next webhook or poll", len(keys))
+		}
+		return
+	}
+
+	sort.Strings(keys)
+	b, err := json.Marshal(keys)
+	if err == nil {
+		err = ioutil.WriteFile(ws.opts.QueueFile, b, 0644)
+	}
+	if err != nil {
+		logrus.Errorf("failed to write the cancelled updates to %s: %s", ws.opts.QueueFile, err)
+		return
+	}
+	logrus.Infof("wrote the cancelled updates of %d repositories to %s", len(keys), ws.opts.QueueFile)
+}
+
+// restoreQueue enqueues the updates that were cancelled on the last shutdown
+func (ws *WebHooksServer) restoreQueue() {
+	if ws.opts.QueueFile == "" {
+		return
+	}
+
+	b, err := ioutil.ReadFile(ws.opts.QueueFile)
+	if os.IsNotExist(err) {
+		return
+	}
+	keys := make([]string, 0)
+	if err == nil {
+		err = json.Unmarshal(b, &keys)
+	}
+	if err != nil {
+		logrus.Errorf("failed to read the cancelled updates from %s: %s", ws.opts.QueueFile, err)
+		return
+	}
+	if err := os.Remove(ws.opts.QueueFile); err != nil {
+		logrus.Errorf("failed to remove %s: %s", ws.opts.QueueFile, err)
+	}
+
+	id := uuid.NewUUID().String()
+	for _, key := range keys {
+		ws.lock.Lock()
+		repo, ok := ws.repositories[key]
+		ws.lock.Unlock()
+		if !ok {
+			logrus.Warnf("not restoring the update of %s as it is not configured anymore", key)
+			continue
+		}
+
+		logrus.Infof("restoring the update of %s cancelled on the last shutdown", key)
+		ws.enqueue(pullTask{id: id, source: audit.SourceRestart, repo: repo})
+	}
+}
+
+// isRunning returns whether the server is accepting updates
+func (ws *WebHooksServer) isRunning() bool {
+	ws.queueLock.RLock()
+	defer ws.queueLock.RUnlock()
+
+	return ws.running
+}
+
+// isReady returns whether the configuration was applied
+func (ws *WebHooksServer) isReady() bool {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+
+	return ws.ready
 }
 
 // WebHookHandler handles a webhook request
 func (ws *WebHooksServer) WebHookHandler(w http.ResponseWriter, r *http.Request) {
-	if !ws.running {
-		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+	if !ws.isRunning() {
+		rejectHook(w, "shutting_down", "server is shutting down", http.StatusServiceUnavailable)
 		return
 	}
-	if !ws.ready {
-		http.Error(w, "Server is not ready to receive requests", http.StatusServiceUnavailable)
+	if !ws.isReady() {
+		rejectHook(w, "not_ready", "Server is not ready to receive requests", http.StatusServiceUnavailable)
 		return
 	}
 
 	if r.Method != "POST" {
-		http.Error(w, fmt.Sprintf("only POST is allowed"), http.StatusBadRequest)
+		rejectHook(w, "invalid_method", fmt.Sprintf("only POST is allowed"), http.StatusBadRequest)
 		return
 	}
 
+	if ws.opts.Allowlist != nil {
+		if reason, err := ws.opts.Allowlist.check(r); err != nil {
+			logrus.Debugf("Rejected webhook from %s: %s", r.RemoteAddr, err)
+			rejectHook(w, reason, "forbidden", http.StatusForbidden)
+			return
+		}
+	}
+
 	metrics.HooksReceivedTotal.Inc()
 
 	id := uuid.NewUUID().String()
 	logrus.Debugf("Received request %s from %s", id, r.RemoteAddr)
 
-	ws.wg.Add(1)
-	defer ws.wg.Done()
-
 	if err := r.ParseForm(); err != nil {
 		logrus.Debugf("Failed to parse form on request %s: %#v", id, r)
-		http.Error(w, fmt.Sprintf("bad request: %s", err), http.StatusBadRequest)
+		rejectHook(w, "invalid_payload", fmt.Sprintf("bad request: %s", err), http.StatusBadRequest)
 		return
 	}
 
 	payload := r.FormValue("payload")
 	if payload == "" {
 		logrus.Debugf("No payload in form for request %s: %#v", id, r.Form)
-		http.Error(w, "no payload in form", http.StatusBadRequest)
+		rejectHook(w, "invalid_payload", "no payload in form", http.StatusBadRequest)
 		return
 	}
 
@@ -209,46 +988,149 @@ func (ws *WebHooksServer) WebHookHandler(w http.ResponseWriter, r *http.Request)
 	hookPayload, err := client.ParseHookPayload(payload)
 	if err != nil {
 		logrus.Debugf("Failed to parse hook payload for request %s: %s - %s", id, err, payload)
-		http.Error(w, fmt.Sprintf("bad request: %s", err), http.StatusBadRequest)
+		rejectHook(w, "invalid_payload", fmt.Sprintf("bad request: %s", err), http.StatusBadRequest)
 		return
 	}
 
 	ws.lock.Lock()
-	defer ws.lock.Unlock()
-
 	repo, ok := ws.repositories[hookPayload.GetRepository()]
+	ws.lock.Unlock()
+
 	if !ok {
-		http.Error(w, fmt.Sprintf("unknown repo %s", hookPayload.GetRepository()), http.StatusNotFound)
+		rejectHook(w, "unknown_repository", fmt.Sprintf("unknown repo %s", hookPayload.GetRepository()), http.StatusNotFound)
 		return
 	}
 
+	if !ws.enqueue(pullTask{id: id, source: audit.SourceWebhook, repo: repo}) {
+		rejectHook(w, "shutting_down", "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
 	metrics.HooksAcceptedTotal.WithLabelValues(hookPayload.GetRepository()).Inc()
 
-	ws.wg.Add(1)
-	ws.tasksCh <- pullTask{id: id, repo: repo}
-
 	w.WriteHeader(http.StatusAccepted)
 }
 
+// rejectHook fails a webhook delivery, counting it by the reason
+func rejectHook(w http.ResponseWriter, reason, message string, code int) {
+	metrics.HooksRejectedTotal.WithLabelValues(reason).Inc()
+	http.Error(w, message, code)
+}
+
 // UpdateAll triggers an update for all the repositories
 func (ws *WebHooksServer) UpdateAll() {
-	if !ws.ready {
+	if !ws.isReady() {
 		logrus.Warnf("Can't update all repos when the service is not ready")
 		return
 	}
 
+	ws.lock.Lock()
+	repositories := make([]Repository, 0, len(ws.repositories))
 	for _, repo := range ws.repositories {
-		ws.wg.Add(1)
-		ws.tasksCh <- pullTask{id: "USR2", repo: repo}
+		repositories = append(repositories, repo)
+	}
+	ws.lock.Unlock()
+
+	id := uuid.NewUUID().String()
+	for _, repo := range repositories {
+		ws.enqueue(pullTask{id: id, source: audit.SourceSignal, repo: repo})
 	}
 }
 
-func (ws *WebHooksServer) updateRepository(requestID string, repo Repository) {
+// enqueue queues the update unless the server is shutting down, blocking
+// while the queue is full
+func (ws *WebHooksServer) enqueue(task pullTask) bool {
+	ws.queueLock.RLock()
+	defer ws.queueLock.RUnlock()
+
+	if !ws.running {
+		logrus.Debugf("not enqueueing %s for request %s as the server is shutting down", task.repo.origin, task.id)
+		return false
+	}
+	ws.wg.Add(1)
+	if task.finished != nil {
+		task.finished.Add(1)
+	}
+	ws.status.queued(task.repo.origin.ToKey())
+	select {
+	case ws.tasksCh <- task:
+		return true
+	default:
+	}
+
+	ws.lock.Lock()
+	ws.blocked++
+	ws.lock.Unlock()
+
+	ws.tasksCh <- task
+
+	ws.lock.Lock()
+	ws.blocked--
+	ws.lock.Unlock()
+	return true
+}
+
+// webhooksEnabled returns whether webhooks are used at all, they are not when
+// the repositories are only kept up to date by polling
+func (ws *WebHooksServer) webhooksEnabled() bool {
+	return ws.WebHooksClient.GetCallbackURL() != ""
+}
+
+func (ws *WebHooksServer) updateRepository(task pullTask) {
 	defer ws.wg.Done()
+	if task.finished != nil {
+		defer task.finished.Done()
+	}
+
+	requestID, repo := task.id, task.repo
+
+	ws.status.started(repo.origin.ToKey())
+	defer ws.status.finished(repo.origin.ToKey())
+
+	record := audit.Record{
+		Time:      time.Now(),
+		RequestID: requestID,
+		Repo:      repo.origin.ToPath(),
+		Key:       repo.origin.ToKey(),
+		Source:    task.source,
+		Refs:      []audit.RefUpdate{},
+	}
+	defer func() {
+		record.DurationSeconds = time.Now().Sub(record.Time).Seconds()
+		ws.opts.AuditLog.Write(record)
+	}()
+	defer func() {
+		if record.Error != "" && ws.ctx.Err() != nil {
+			ws.lock.Lock()
+			ws.cancelled[repo.origin.ToKey()] = true
+			ws.lock.Unlock()
+		}
+	}()
+
+	if ws.ctx.Err() != nil {
+		logrus.Infof("not updating %s for request %s as the server is shutting down", repo.origin, requestID)
+		record.Error = "cancelled, the server is shutting down"
+		return
+	}
+
+	if ws.status.isPaused(repo.origin.ToKey()) {
+		logrus.Infof("repository %s is paused, recording request %s from %s without updating it", repo.origin, requestID, task.source)
+		record.Paused = true
+		ws.status.deferred(repo.origin.ToKey())
+		return
+	}
+
+	defer ws.repoLocks.acquire(repo.origin.ToKey())()
+
+	before, err := repo.localRefs()
+	if err != nil {
+		logrus.Warnf("failed to read refs of %s before fetching for request %s: %s", repo.origin, requestID, err)
+	}
 
 	startFetch := time.Now()
 	if err := repo.Fetch(); err != nil {
 		logrus.Errorf("failed to fetch repo %s for request %s: %s", repo.origin, requestID, err)
+		record.Error = fmt.Sprintf("failed to fetch: %s", err)
+		ws.status.failed(repo.origin.ToKey(), err)
 		metrics.HooksFailedTotal.WithLabelValues(repo.origin.ToPath()).Inc()
 		metrics.RepoIsUp.WithLabelValues(repo.origin.ToPath()).Set(0)
 		return
@@ -257,9 +1139,25 @@ func (ws *WebHooksServer) updateRepository(requestID string, repo Repository) {
 	metrics.HooksUpdatedTotal.WithLabelValues(repo.origin.ToPath()).Inc()
 	metrics.RepoIsUp.WithLabelValues(repo.origin.ToPath()).Set(1)
 
+	after, err := repo.localRefs()
+	if err != nil {
+		logrus.Warnf("failed to read refs of %s after fetching for request %s: %s", repo.origin, requestID, err)
+	} else {
+		ws.status.fetched(repo.origin.ToKey(), after)
+		if before != nil {
+			ws.checkRewrites(requestID, repo, before, after)
+		}
+	}
+
 	startPush := time.Now()
-	if err := repo.Push(); err != nil {
+	updates, err := repo.Push()
+	if updates != nil {
+		record.Refs = updates
+	}
+	if err != nil {
 		logrus.Errorf("failed to push repo %s to %s for request %s: %s", repo.origin, repo.target, requestID, err)
+		record.Error = fmt.Sprintf("failed to push: %s", err)
+		ws.status.failed(repo.origin.ToKey(), err)
 		metrics.HooksFailedTotal.WithLabelValues(repo.target.ToPath()).Inc()
 		metrics.RepoIsUp.WithLabelValues(repo.target.ToPath()).Set(0)
 		return
@@ -267,6 +1165,30 @@ func (ws *WebHooksServer) updateRepository(requestID string, repo Repository) {
 	metrics.GitLatencySecondsTotal.WithLabelValues("push", repo.target.ToPath()).Observe(((time.Now().Sub(startPush)).Seconds()))
 	metrics.HooksUpdatedTotal.WithLabelValues(repo.target.ToPath()).Inc()
 	metrics.RepoIsUp.WithLabelValues(repo.target.ToPath()).Set(1)
+	ws.status.pushed(repo.origin.ToKey())
 
 	logrus.Debugf("repository %s pushed to %s for request %s", repo.origin, repo.target, requestID)
 }
+
+// checkRewrites looks for branches that were force pushed in origin, backing
+// up their old tip in target when the repository is configured to do so
+func (ws *WebHooksServer) checkRewrites(requestID string, repo Repository, before, after map[plumbing.ReferenceName]plumbing.Hash) {
+	rewrites, err := repo.findRewrites(before, after)
+	if err != nil {
+		logrus.Warnf("failed to look for rewrites in %s for request %s: %s", repo.origin, requestID, err)
+		return
+	}
+
+	now := time.Now()
+	for _, rw := range rewrites {
+		logrus.Warnf("branch %s was force pushed in %s from %s to %s for request %s", rw.branch, repo.origin, rw.old, rw.new, requestID)
+		metrics.UpstreamForcePushesTotal.WithLabelValues(repo.origin.ToPath()).Inc()
+
+		if !repo.settings.backupRewrites {
+			continue
+		}
+		if err := repo.backupRewrite(rw, now); err != nil {
+			logrus.Errorf("failed to back up %s of %s for request %s: %s", rw.old, rw.branch, requestID, err)
+		}
+	}
+}
@@ -2,13 +2,17 @@ package server
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	httpurl "net/url"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
+	"gitlab.com/yakshaving.art/git-pull-mirror/audit"
 	"gitlab.com/yakshaving.art/git-pull-mirror/config"
 	"gitlab.com/yakshaving.art/git-pull-mirror/github"
 	"gitlab.com/yakshaving.art/git-pull-mirror/url"
@@ -58,7 +62,7 @@ func TestBuildingAServerAndConfigureWithEmptyConfigWorks(t *testing.T) {
 		}, c)
 	}()
 	<-c
-	defer s.Shutdown()
+	defer s.Shutdown(time.Minute)
 
 	tt := []struct {
 		name string
@@ -101,6 +105,382 @@ func TestBuildingAServerAndConfigureWithEmptyConfigWorks(t *testing.T) {
 
 }
 
+func TestConfiguringManyRepositories(t *testing.T) {
+	_, dir := newTestGitClient(t)
+	defer os.RemoveAll(dir)
+
+	c := config.Config{}
+	for i := 0; i < 7; i++ {
+		name := fmt.Sprintf("repo%d", i)
+		origin := newTestRepo(t, dir, "origin", name)
+		origin.commit(t, "README", name)
+		target := newBareTestRepo(t, dir, "target", name)
+		c.Repositories = append(c.Repositories, config.RepositoryConfig{OriginURL: origin.url, TargetURL: target.url})
+	}
+
+	ws := New(newFakeWebhooksClient(0), WebHooksServerOptions{
+		GitTimeoutSeconds: 10,
+		RepositoriesPath:  filepath.Join(dir, "local"),
+		Concurrency:       1,
+		ConfigConcurrency: 2,
+		StrictConfig:      true,
+	})
+	must(t, "failed to configure", ws.Configure(c))
+	if len(ws.repositories) != len(c.Repositories) {
+		t.Fatalf("Expected %d repositories to be configured, got %d", len(c.Repositories), len(ws.repositories))
+	}
+
+	missing := newTestRepo(t, dir, "origin", "missing")
+	broken := config.Config{Repositories: append(c.Repositories, config.RepositoryConfig{
+		OriginURL: missing.url,
+		TargetURL: c.Repositories[0].TargetURL,
+	})}
+	if err := ws.Configure(broken); err == nil {
+		t.Fatalf("Expected configuring an empty origin to fail")
+	}
+	if len(ws.repositories) != len(c.Repositories) {
+		t.Fatalf("Expected the previous %d repositories to be kept, got %d", len(c.Repositories), len(ws.repositories))
+	}
+}
+
+func TestConfiguringWithDegradedRepositories(t *testing.T) {
+	_, dir := newTestGitClient(t)
+	defer os.RemoveAll(dir)
+
+	healthy := newTestRepo(t, dir, "origin", "healthy")
+	healthy.commit(t, "README", "healthy")
+	missing := newTestRepo(t, dir, "origin", "missing")
+
+	c := config.Config{Repositories: []config.RepositoryConfig{
+		{OriginURL: healthy.url, TargetURL: newBareTestRepo(t, dir, "target", "healthy").url},
+		{OriginURL: missing.url, TargetURL: newBareTestRepo(t, dir, "target", "missing").url},
+	}}
+
+	ws := New(newFakeWebhooksClient(0), WebHooksServerOptions{
+		GitTimeoutSeconds: 10,
+		RepositoriesPath:  filepath.Join(dir, "local"),
+		Concurrency:       1,
+	})
+	must(t, "failed to configure with a degraded repository", ws.Configure(c))
+	if !ws.isReady() {
+		t.Fatalf("Expected the server to be ready with a degraded repository")
+	}
+	if _, ok := ws.repositories["origin/healthy"]; !ok {
+		t.Fatalf("Expected the healthy repository to be active")
+	}
+	if _, ok := ws.repositories["origin/missing"]; ok {
+		t.Fatalf("Expected the missing repository not to be active")
+	}
+
+	status, _ := ws.status.get("origin/missing")
+	assertEquals(t, StateDegraded, status.State)
+	if status.LastError == "" || status.NextRetry == nil {
+		t.Fatalf("Expected the degraded repository to have an error and a next retry, got %#v", status)
+	}
+
+	// Still failing, it is kept degraded
+	ws.retryDegraded("origin/missing")
+	if _, ok := ws.degraded["origin/missing"]; !ok {
+		t.Fatalf("Expected the missing repository to still be degraded")
+	}
+
+	missing.commit(t, "README", "missing")
+	ws.retryDegraded("origin/missing")
+	if _, ok := ws.degraded["origin/missing"]; ok {
+		t.Fatalf("Expected the missing repository to recover")
+	}
+	if _, ok := ws.repositories["origin/missing"]; !ok {
+		t.Fatalf("Expected the recovered repository to be active")
+	}
+	status, _ = ws.status.get("origin/missing")
+	assertEquals(t, StateIdle, status.State)
+}
+
+func TestRetryingDegradedRepositoriesDoesNotBlockTheConfiguration(t *testing.T) {
+	_, dir := newTestGitClient(t)
+	defer os.RemoveAll(dir)
+
+	missing := newTestRepo(t, dir, "origin", "missing")
+	c := config.Config{Repositories: []config.RepositoryConfig{
+		{OriginURL: missing.url, TargetURL: newBareTestRepo(t, dir, "target", "missing").url},
+	}}
+
+	client := newFakeWebhooksClient(0)
+	ws := New(client, WebHooksServerOptions{
+		GitTimeoutSeconds: 10,
+		RepositoriesPath:  filepath.Join(dir, "local"),
+		Concurrency:       1,
+	})
+	must(t, "failed to configure with a degraded repository", ws.Configure(c))
+	missing.commit(t, "README", "missing")
+
+	// The repository is deleted while the retry is setting it up
+	client.onRegister = func(u url.GitURL) {
+		client.onRegister = nil
+		must(t, "failed to delete the repository while retrying it", ws.DeleteRepository("origin/missing", ""))
+	}
+	ws.retryDegraded("origin/missing")
+
+	if client.onRegister != nil {
+		t.Fatalf("Expected the retry to set up the repository")
+	}
+	if _, ok := ws.repositories["origin/missing"]; ok {
+		t.Fatalf("Expected the deleted repository not to be activated by the retry")
+	}
+	if _, ok := ws.webhooks.Status("origin/missing"); ok {
+		t.Fatalf("Expected the webhook of the deleted repository not to be registered by the retry")
+	}
+}
+
+func TestPausedRepositoriesAreNotPolled(t *testing.T) {
+	_, dir := newTestGitClient(t)
+	defer os.RemoveAll(dir)
+
+	repos := make([]config.RepositoryConfig, 0)
+	for _, name := range []string{"active", "paused"} {
+		origin := newTestRepo(t, dir, "origin", name)
+		origin.commit(t, "README", name)
+		target := newBareTestRepo(t, dir, "target", name)
+		repos = append(repos, config.RepositoryConfig{OriginURL: origin.url, TargetURL: target.url, PollInterval: time.Hour, Paused: name == "paused"})
+	}
+
+	ws := New(newFakeWebhooksClient(0), WebHooksServerOptions{
+		GitTimeoutSeconds: 10,
+		RepositoriesPath:  filepath.Join(dir, "local"),
+		Concurrency:       1,
+	})
+	must(t, "failed to configure", ws.Configure(config.Config{Repositories: repos}))
+	defer ws.poller.Stop()
+
+	polls := func() int {
+		ws.poller.lock.Lock()
+		defer ws.poller.lock.Unlock()
+		return len(ws.poller.stops)
+	}
+	if n := polls(); n != 1 {
+		t.Fatalf("Expected only the active repository to be polled, got %d polls", n)
+	}
+
+	must(t, "failed to pause the active repository", ws.SetPaused("origin/active", true, ""))
+	if n := polls(); n != 0 {
+		t.Fatalf("Expected no polls once every repository is paused, got %d", n)
+	}
+}
+
+func TestDiffingConfigurations(t *testing.T) {
+	repo := func(name string, paused bool) config.RepositoryConfig {
+		origin, err := url.Parse("https://github.com/owner/" + name + ".git")
+		must(t, "could not parse origin url", err)
+		return config.RepositoryConfig{Origin: origin.URI, OriginURL: origin, Paused: paused}
+	}
+	keys := func(repos []config.RepositoryConfig) string {
+		names := make([]string, 0, len(repos))
+		for _, r := range repos {
+			names = append(names, r.OriginURL.Name)
+		}
+		return strings.Join(names, ",")
+	}
+
+	tt := []struct {
+		name      string
+		previous  []config.RepositoryConfig
+		current   []config.RepositoryConfig
+		added     string
+		removed   string
+		changed   string
+		unchanged string
+	}{
+		{
+			name:    "first configuration",
+			current: []config.RepositoryConfig{repo("a", false), repo("b", false)},
+			added:   "a,b",
+		},
+		{
+			name:      "same configuration",
+			previous:  []config.RepositoryConfig{repo("a", false), repo("b", false)},
+			current:   []config.RepositoryConfig{repo("b", false), repo("a", false)},
+			unchanged: "b,a",
+		},
+		{
+			name:      "added, removed and changed",
+			previous:  []config.RepositoryConfig{repo("a", false), repo("b", false), repo("c", false)},
+			current:   []config.RepositoryConfig{repo("a", false), repo("b", true), repo("d", false)},
+			added:     "d",
+			removed:   "c",
+			changed:   "b",
+			unchanged: "a",
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			diff := diffConfigs(config.Config{Repositories: tc.previous}, config.Config{Repositories: tc.current})
+			assertEquals(t, tc.added, keys(diff.added))
+			assertEquals(t, tc.removed, keys(diff.removed))
+			assertEquals(t, tc.changed, keys(diff.changed))
+			assertEquals(t, tc.unchanged, keys(diff.unchanged))
+		})
+	}
+}
+
+func TestReloadingOnlyTouchesChangedRepositories(t *testing.T) {
+	_, dir := newTestGitClient(t)
+	defer os.RemoveAll(dir)
+
+	repos := make([]config.RepositoryConfig, 0)
+	for _, name := range []string{"unchanged", "changed", "removed", "added"} {
+		origin := newTestRepo(t, dir, "origin", name)
+		origin.commit(t, "README", name)
+		target := newBareTestRepo(t, dir, "target", name)
+		repos = append(repos, config.RepositoryConfig{OriginURL: origin.url, TargetURL: target.url})
+	}
+
+	ws := New(newFakeWebhooksClient(0), WebHooksServerOptions{
+		GitTimeoutSeconds: 10,
+		RepositoriesPath:  filepath.Join(dir, "local"),
+		Concurrency:       1,
+	})
+	must(t, "failed to configure", ws.Configure(config.Config{Repositories: repos[:3]}))
+	unchanged := ws.repositories["origin/unchanged"]
+	changed := ws.repositories["origin/changed"]
+
+	reloaded := []config.RepositoryConfig{repos[0], repos[1], repos[3]}
+	reloaded[1].OnDivergence = config.DivergenceSkip
+	must(t, "failed to reload", ws.Configure(config.Config{Repositories: reloaded}))
+
+	if ws.repositories["origin/unchanged"].repo != unchanged.repo {
+		t.Fatalf("Expected the unchanged repository not to be set up again")
+	}
+	if ws.repositories["origin/changed"].repo == changed.repo {
+		t.Fatalf("Expected the changed repository to be set up again")
+	}
+	assertEquals(t, config.DivergenceSkip, ws.repositories["origin/changed"].settings.onDivergence)
+	if _, ok := ws.repositories["origin/removed"]; ok {
+		t.Fatalf("Expected the removed repository to be gone")
+	}
+	if _, ok := ws.repositories["origin/added"]; !ok {
+		t.Fatalf("Expected the added repository to be set up")
+	}
+}
+
+func TestChangedRepositoriesKeepRunningUntilTheyAreSetUpAgain(t *testing.T) {
+	_, dir := newTestGitClient(t)
+	defer os.RemoveAll(dir)
+
+	origin := newTestRepo(t, dir, "origin", "repo")
+	origin.commit(t, "README", "first")
+	target := newBareTestRepo(t, dir, "target", "repo")
+	repo := config.RepositoryConfig{OriginURL: origin.url, TargetURL: target.url}
+
+	ws := New(newFakeWebhooksClient(0), WebHooksServerOptions{
+		GitTimeoutSeconds: 10,
+		RepositoriesPath:  filepath.Join(dir, "local"),
+		Concurrency:       1,
+	})
+	must(t, "failed to configure", ws.Configure(config.Config{Repositories: []config.RepositoryConfig{repo}}))
+	running := ws.repositories["origin/repo"]
+
+	// The setup waits for the update running on the local copy
+	unlock := ws.repoLocks.acquire("origin/repo")
+	changed := repo
+	changed.BackupRewrites = true
+	configured := make(chan error)
+	go func() {
+		configured <- ws.Configure(config.Config{Repositories: []config.RepositoryConfig{changed}})
+	}()
+	select {
+	case <-configured:
+		t.Fatalf("Expected the changed repository to wait for the running update")
+	case <-time.After(100 * time.Millisecond):
+	}
+	unlock()
+	must(t, "failed to reload", <-configured)
+	if !ws.repositories["origin/repo"].settings.backupRewrites {
+		t.Fatalf("Expected the changed repository to be set up again")
+	}
+	running = ws.repositories["origin/repo"]
+
+	// Failing to set it up again keeps the running one until a retry succeeds
+	must(t, "failed to hide origin", os.Rename(origin.path, origin.path+".hidden"))
+	changed.BackupRewrites = false
+	must(t, "failed to reload", ws.Configure(config.Config{Repositories: []config.RepositoryConfig{changed}}))
+
+	if ws.repositories["origin/repo"].repo != running.repo {
+		t.Fatalf("Expected the running repository to be kept when it fails to be set up again")
+	}
+	if _, ok := ws.degraded["origin/repo"]; !ok {
+		t.Fatalf("Expected the repository to be retried with its new configuration")
+	}
+}
+
+func TestShuttingDown(t *testing.T) {
+	_, dir := newTestGitClient(t)
+	defer os.RemoveAll(dir)
+
+	origin := newTestRepo(t, dir, "origin", "repo")
+	origin.commit(t, "README", "first")
+	target := newBareTestRepo(t, dir, "target", "repo")
+	queueFile := filepath.Join(dir, "queue.json")
+
+	newServer := func() *WebHooksServer {
+		ws := New(newFakeWebhooksClient(0), WebHooksServerOptions{
+			GitTimeoutSeconds: 10,
+			RepositoriesPath:  filepath.Join(dir, "local"),
+			Concurrency:       1,
+			QueueFile:         queueFile,
+		})
+		must(t, "failed to configure", ws.Configure(config.Config{
+			Repositories: []config.RepositoryConfig{{OriginURL: origin.url, TargetURL: target.url}},
+		}))
+		ws.running = true
+		return ws
+	}
+
+	// The worker is stuck until the updates are cancelled
+	ws := newServer()
+	go func() {
+		<-ws.ctx.Done()
+		for task := range ws.tasksCh {
+			ws.updateRepository(task)
+		}
+	}()
+
+	head := origin.commit(t, "README", "second")
+	ws.UpdateAll()
+
+	if err := ws.Shutdown(10 * time.Millisecond); err != ErrShutdownTimeout {
+		t.Fatalf("Expected shutdown to time out, got %v", err)
+	}
+	if ws.enqueue(pullTask{id: "late", repo: ws.repositories["origin/repo"]}) {
+		t.Fatalf("Updates should not be enqueued after shutting down")
+	}
+	must(t, "shutting down twice should be a noop", ws.Shutdown(time.Minute))
+
+	records := ws.opts.AuditLog.Query("localhost/origin/repo", "", 1)
+	assertEquals(t, "cancelled, the server is shutting down", records[0].Error)
+	b, err := ioutil.ReadFile(queueFile)
+	must(t, "failed to read queue file", err)
+	assertEquals(t, `["origin/repo"]`, string(b))
+
+	// The cancelled update runs on the next start
+	ws = newServer()
+	go func() {
+		for task := range ws.tasksCh {
+			ws.updateRepository(task)
+		}
+	}()
+	ws.restoreQueue()
+	must(t, "failed to shut down", ws.Shutdown(time.Minute))
+
+	if h := target.head(t, "master"); h != head {
+		t.Fatalf("Expected the restored update to push %s, got %s", head, h)
+	}
+	records = ws.opts.AuditLog.Query("localhost/origin/repo", "", 1)
+	assertEquals(t, audit.SourceRestart, records[0].Source)
+	if _, err := os.Stat(queueFile); !os.IsNotExist(err) {
+		t.Fatalf("Expected the queue file to be removed, got %v", err)
+	}
+}
+
 func must(t *testing.T, desc string, err error) {
 	if err != nil {
 		t.Fatalf("%s, got error %s", desc, err)
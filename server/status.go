@@ -0,0 +1,272 @@
+package server
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"gitlab.com/yakshaving.art/git-pull-mirror/config"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+// Repository sync states
+const (
+	StateIdle     = "idle"
+	StateQueued   = "queued"
+	StateRunning  = "running"
+	StatePaused   = "paused"
+	StateDegraded = "degraded"
+)
+
+// RepositoryStatus is the sync status of a configured mirror
+type RepositoryStatus struct {
+	Key           string         `json:"key"`
+	Origin        string         `json:"origin"`
+	Target        string         `json:"target"`
+	Source        string         `json:"source,omitempty"`
+	State         string         `json:"state"`
+	Paused        bool           `json:"paused"`
+	Pending       int            `json:"pending_updates,omitempty"`
+	LastFetch     *time.Time     `json:"last_fetch,omitempty"`
+	LastPush      *time.Time     `json:"last_push,omitempty"`
+	LastError     string         `json:"last_error,omitempty"`
+	LastErrorTime *time.Time     `json:"last_error_time,omitempty"`
+	NextRetry     *time.Time     `json:"next_retry,omitempty"`
+	Refs          RefCounts      `json:"refs"`
+	Webhook       *WebhookStatus `json:"webhook,omitempty"`
+}
+
+// RefCounts is how many branches and tags were fetched from origin
+type RefCounts struct {
+	Branches int `json:"branches"`
+	Tags     int `json:"tags"`
+}
+
+// statusStore keeps the sync status of every configured repository, it is
+// updated as the repositories are configured and updated
+type statusStore struct {
+	lock  *sync.Mutex
+	repos map[string]*repositoryState
+}
+
+type repositoryState struct {
+	origin  string
+	target  string
+	source  string
+	queued  int
+	running bool
+	paused  bool
+	pending int
+
+	// degraded repositories failed to be set up and are retried at nextRetry
+	degraded  bool
+	nextRetry time.Time
+
+	lastFetch     time.Time
+	lastPush      time.Time
+	lastError     string
+	lastErrorTime time.Time
+	refs          RefCounts
+}
+
+func newStatusStore() *statusStore {
+	return &statusStore{
+		lock:  &sync.Mutex{},
+		repos: make(map[string]*repositoryState),
+	}
+}
+
+// configure tracks the repositories in the configuration, keeping the status
+// of the ones that were already tracked and forgetting the removed ones. It
+// returns the keys of the repositories that were resumed.
+func (s *statusStore) configure(c config.Config) []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	resumed := make([]string, 0)
+	repos := make(map[string]*repositoryState, len(c.Repositories))
+	for _, r := range c.Repositories {
+		state, ok := s.repos[r.OriginURL.ToKey()]
+		if !ok {
+			state = &repositoryState{}
+		}
+		if state.paused && !r.Paused {
+			resumed = append(resumed, r.OriginURL.ToKey())
+			state.pending = 0
+		}
+		state.origin = r.OriginURL.ToPath()
+		state.target = r.TargetURL.ToPath()
+		state.source = r.Source()
+		state.paused = r.Paused
+		repos[r.OriginURL.ToKey()] = state
+	}
+	s.repos = repos
+	return resumed
+}
+
+// isPaused returns whether the repository is paused
+func (s *statusStore) isPaused(key string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	state, ok := s.repos[key]
+	return ok && state.paused
+}
+
+// deferred records an update that was not run because the repository is paused
+func (s *statusStore) deferred(key string) {
+	s.update(key, func(state *repositoryState) {
+		state.pending++
+	})
+}
+
+// queued records that an update was enqueued for the repository
+func (s *statusStore) queued(key string) {
+	s.update(key, func(state *repositoryState) {
+		state.queued++
+	})
+}
+
+// started records that a queued update started running
+func (s *statusStore) started(key string) {
+	s.update(key, func(state *repositoryState) {
+		if state.queued > 0 {
+			state.queued--
+		}
+		state.running = true
+	})
+}
+
+// finished records that a running update is done
+func (s *statusStore) finished(key string) {
+	s.update(key, func(state *repositoryState) {
+		state.running = false
+	})
+}
+
+// fetched records a successful fetch and counts the refs fetched from origin
+func (s *statusStore) fetched(key string, refs map[plumbing.ReferenceName]plumbing.Hash) {
+	counts := RefCounts{}
+	for name := range refs {
+		switch {
+		case name.IsBranch():
+			counts.Branches++
+		case name.IsTag():
+			counts.Tags++
+		}
+	}
+
+	s.update(key, func(state *repositoryState) {
+		state.lastFetch = time.Now()
+		state.refs = counts
+	})
+}
+
+// pushed records a successful push, which clears the last error
+func (s *statusStore) pushed(key string) {
+	s.update(key, func(state *repositoryState) {
+		state.lastPush = time.Now()
+		state.lastError = ""
+		state.lastErrorTime = time.Time{}
+	})
+}
+
+// degraded records that the repository failed to be set up and when it will be retried
+func (s *statusStore) degraded(key string, nextRetry time.Time) {
+	s.update(key, func(state *repositoryState) {
+		state.degraded = true
+		state.nextRetry = nextRetry
+	})
+}
+
+// recovered records that the repository is set up, which clears the last error
+func (s *statusStore) recovered(key string) {
+	s.update(key, func(state *repositoryState) {
+		state.degraded = false
+		state.nextRetry = time.Time{}
+		state.lastError = ""
+		state.lastErrorTime = time.Time{}
+	})
+}
+
+// failed records the last error of the repository
+func (s *statusStore) failed(key string, err error) {
+	s.update(key, func(state *repositoryState) {
+		state.lastError = err.Error()
+		state.lastErrorTime = time.Now()
+	})
+}
+
+func (s *statusStore) update(key string, f func(*repositoryState)) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if state, ok := s.repos[key]; ok {
+		f(state)
+	}
+}
+
+// get returns the status of a single repository
+func (s *statusStore) get(key string) (RepositoryStatus, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	state, ok := s.repos[key]
+	if !ok {
+		return RepositoryStatus{}, false
+	}
+	return state.status(key), true
+}
+
+// list returns the status of all the repositories sorted by key
+func (s *statusStore) list() []RepositoryStatus {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	statuses := make([]RepositoryStatus, 0, len(s.repos))
+	for key, state := range s.repos {
+		statuses = append(statuses, state.status(key))
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Key < statuses[j].Key
+	})
+	return statuses
+}
+
+func (state *repositoryState) status(key string) RepositoryStatus {
+	status := RepositoryStatus{
+		Key:       key,
+		Origin:    state.origin,
+		Target:    state.target,
+		Source:    state.source,
+		State:     StateIdle,
+		Paused:    state.paused,
+		Pending:   state.pending,
+		LastError: state.lastError,
+		Refs:      state.refs,
+	}
+
+	switch {
+	case state.running:
+		status.State = StateRunning
+	case state.queued > 0:
+		status.State = StateQueued
+	case state.degraded:
+		status.State = StateDegraded
+	case state.paused:
+		status.State = StatePaused
+	}
+
+	status.LastFetch = timeOrNil(state.lastFetch)
+	status.LastPush = timeOrNil(state.lastPush)
+	status.LastErrorTime = timeOrNil(state.lastErrorTime)
+	status.NextRetry = timeOrNil(state.nextRetry)
+	return status
+}
+
+func timeOrNil(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// CertificateReloader serves a certificate loaded from disk that can be
+// reloaded without restarting the listeners that use it
+type CertificateReloader struct {
+	certFile string
+	keyFile  string
+
+	lock *sync.RWMutex
+	cert *tls.Certificate
+}
+
+// NewCertificateReloader loads the certificate and key files
+func NewCertificateReloader(certFile, keyFile string) (*CertificateReloader, error) {
+	c := &CertificateReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		lock:     &sync.RWMutex{},
+	}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reload loads the certificate and key files again, the current certificate
+// is kept when they can't be loaded
+func (c *CertificateReloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate %s: %s", c.certFile, err)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.cert = &cert
+	logrus.Infof("loaded certificate %s", c.certFile)
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate
+func (c *CertificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.cert, nil
+}
+
+// TLSConfig returns a tls configuration that serves the certificates of the
+// reloader and verifies the client certificates against the CA file, if any
+func TLSConfig(certs *CertificateReloader, clientCAFile string, clientAuth tls.ClientAuthType) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		GetCertificate: certs.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+
+	if clientCAFile != "" {
+		pem, err := ioutil.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client CA %s: %s", clientCAFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates could be parsed from client CA %s", clientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = clientAuth
+	}
+	return tlsConfig, nil
+}
+
+// newHTTPServer returns an http server with the timeouts of the options, the
+// write timeout is left out for the listeners that serve long requests
+func (ws *WebHooksServer) newHTTPServer(address string, handler http.Handler, tlsConfig *tls.Config, writeTimeout bool) *http.Server {
+	server := &http.Server{
+		Addr:        address,
+		Handler:     handler,
+		TLSConfig:   tlsConfig,
+		ReadTimeout: time.Duration(ws.opts.ReadTimeoutSeconds) * time.Second,
+		IdleTimeout: time.Duration(ws.opts.IdleTimeoutSeconds) * time.Second,
+	}
+	if writeTimeout {
+		server.WriteTimeout = time.Duration(ws.opts.WriteTimeoutSeconds) * time.Second
+	}
+	return server
+}
+
+// listenAndServe serves with tls when the server has a tls configuration
+func listenAndServe(server *http.Server) error {
+	if server.TLSConfig != nil {
+		return server.ListenAndServeTLS("", "")
+	}
+	return server.ListenAndServe()
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCertificate writes a self signed certificate and its key to the
+// directory and returns their file names
+func writeCertificate(t *testing.T, dir, name string, serial int64) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	must(t, "failed to generate key", err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{"localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	must(t, "failed to create certificate", err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	must(t, "failed to marshal key", err)
+
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+	must(t, "failed to write certificate", ioutil.WriteFile(certFile,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	must(t, "failed to write key", ioutil.WriteFile(keyFile,
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	return certFile, keyFile
+}
+
+func servedSerial(t *testing.T, certs *CertificateReloader) int64 {
+	cert, err := certs.GetCertificate(nil)
+	must(t, "failed to get certificate", err)
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	must(t, "failed to parse certificate", err)
+	return parsed.SerialNumber.Int64()
+}
+
+func TestReloadingCertificates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	must(t, "failed to create temp dir", err)
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := writeCertificate(t, dir, "server", 1)
+	certs, err := NewCertificateReloader(certFile, keyFile)
+	must(t, "failed to load certificate", err)
+	if serial := servedSerial(t, certs); serial != 1 {
+		t.Fatalf("expected serial 1, got %d", serial)
+	}
+
+	writeCertificate(t, dir, "server", 2)
+	must(t, "failed to reload certificate", certs.Reload())
+	if serial := servedSerial(t, certs); serial != 2 {
+		t.Fatalf("expected serial 2 after reloading, got %d", serial)
+	}
+
+	must(t, "failed to break certificate", ioutil.WriteFile(certFile, []byte("garbage"), 0600))
+	if err := certs.Reload(); err == nil {
+		t.Fatalf("expected reloading a broken certificate to fail")
+	}
+	if serial := servedSerial(t, certs); serial != 2 {
+		t.Fatalf("expected serial 2 to be kept after a failed reload, got %d", serial)
+	}
+}
+
+func TestVerifyingClientCertificates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	must(t, "failed to create temp dir", err)
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := writeCertificate(t, dir, "server", 1)
+	clientCert, clientKey := writeCertificate(t, dir, "client", 2)
+	certs, err := NewCertificateReloader(certFile, keyFile)
+	must(t, "failed to load certificate", err)
+	tlsConfig, err := TLSConfig(certs, clientCert, tls.RequireAndVerifyClientCert)
+	must(t, "failed to create tls config", err)
+
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	s.TLS = tlsConfig
+	s.StartTLS()
+	defer s.Close()
+
+	serverPEM, err := ioutil.ReadFile(certFile)
+	must(t, "failed to read server certificate", err)
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(serverPEM)
+	client, err := tls.LoadX509KeyPair(clientCert, clientKey)
+	must(t, "failed to load client certificate", err)
+
+	tt := []struct {
+		name         string
+		certificates []tls.Certificate
+		succeeds     bool
+	}{
+		{"without a client certificate", nil, false},
+		{"with a client certificate", []tls.Certificate{client}, true},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			c := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+				RootCAs:      roots,
+				ServerName:   "localhost",
+				Certificates: tc.certificates,
+			}}}
+			resp, err := c.Get(s.URL)
+			if !tc.succeeds {
+				if err == nil {
+					resp.Body.Close()
+					t.Fatalf("expected the request to fail without a client certificate")
+				}
+				return
+			}
+			must(t, "failed to request", err)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("unexpected status %d", resp.StatusCode)
+			}
+		})
+	}
+}
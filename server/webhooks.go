@@ -0,0 +1,201 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/jpillora/backoff"
+	"github.com/sirupsen/logrus"
+	"gitlab.com/yakshaving.art/git-pull-mirror/metrics"
+	"gitlab.com/yakshaving.art/git-pull-mirror/url"
+	"gitlab.com/yakshaving.art/git-pull-mirror/webhooks"
+)
+
+// how often the reconciler wakes up to look for registrations to retry or verify
+var reconcileTick = 5 * time.Second
+
+// webhooksReconciler keeps track of the registration state of the webhook of
+// every repository, retrying the failed ones with backoff and periodically
+// registering again the successful ones to verify they are still in place
+type webhooksReconciler struct {
+	lock *sync.Mutex
+
+	client         webhooks.Client
+	verifyInterval time.Duration
+	hooks          map[string]*webhookState
+}
+
+type webhookState struct {
+	url         url.GitURL
+	registered  bool
+	lastError   error
+	lastAttempt time.Time
+	nextAttempt time.Time
+	backoff     *backoff.Backoff
+
+	// removed is set when the webhook is unregistered, so the attempts that
+	// were already running don't register it again
+	removed bool
+}
+
+// WebhookStatus is the registration status of a repository webhook
+type WebhookStatus struct {
+	Registered  bool      `json:"registered"`
+	LastError   string    `json:"last_error,omitempty"`
+	LastAttempt time.Time `json:"last_attempt"`
+}
+
+func newWebhooksReconciler(client webhooks.Client, verifyInterval time.Duration) *webhooksReconciler {
+	return &webhooksReconciler{
+		lock:           &sync.Mutex{},
+		client:         client,
+		verifyInterval: verifyInterval,
+		hooks:          make(map[string]*webhookState),
+	}
+}
+
+// Register tries to register the webhook for the given url right away. If it
+// fails the registration will be retried in the background.
+func (w *webhooksReconciler) Register(u url.GitURL) {
+	w.lock.Lock()
+	state, ok := w.hooks[u.ToKey()]
+	if !ok {
+		state = &webhookState{
+			url: u,
+			backoff: &backoff.Backoff{
+				Min:    10 * time.Second,
+				Max:    10 * time.Minute,
+				Factor: 2,
+				Jitter: true,
+			},
+		}
+		w.hooks[u.ToKey()] = state
+	}
+	state.url = u
+	w.lock.Unlock()
+
+	w.attempt(state)
+}
+
+// Unregister removes the webhook for the given url and stops tracking it
+func (w *webhooksReconciler) Unregister(u url.GitURL) {
+	w.lock.Lock()
+	if state, ok := w.hooks[u.ToKey()]; ok {
+		state.removed = true
+		delete(w.hooks, u.ToKey())
+	}
+	w.lock.Unlock()
+
+	metrics.WebhookRegistered.DeleteLabelValues(u.ToPath())
+	metrics.WebhookLastErrorTimestamp.DeleteLabelValues(u.ToPath())
+
+	if err := w.client.UnregisterWebhook(u); err != nil {
+		logrus.Warnf("failed to unregister webhook for %s: %s", u, err)
+	}
+}
+
+// Status returns the registration status of the webhook for the given key
+func (w *webhooksReconciler) Status(key string) (WebhookStatus, bool) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	state, ok := w.hooks[key]
+	if !ok {
+		return WebhookStatus{}, false
+	}
+
+	status := WebhookStatus{
+		Registered:  state.registered,
+		LastAttempt: state.lastAttempt,
+	}
+	if state.lastError != nil {
+		status.LastError = state.lastError.Error()
+	}
+	return status, true
+}
+
+// Run retries failed registrations and verifies the successful ones until the
+// done channel is closed
+func (w *webhooksReconciler) Run(done chan interface{}) {
+	ticker := time.NewTicker(reconcileTick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			for _, state := range w.due(time.Now()) {
+				w.attempt(state)
+			}
+		}
+	}
+}
+
+// due returns the registrations that need to be retried or verified
+func (w *webhooksReconciler) due(now time.Time) []*webhookState {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	due := make([]*webhookState, 0)
+	for _, state := range w.hooks {
+		if !state.registered && !now.Before(state.nextAttempt) {
+			due = append(due, state)
+		} else if state.registered && w.verifyInterval > 0 && now.Sub(state.lastAttempt) >= w.verifyInterval {
+			due = append(due, state)
+		}
+	}
+	return due
+}
+
+// attempt registers the webhook of the state, unless it was unregistered in the
+// meantime. When it is unregistered while registering the webhook is removed
+// again, as nothing would track it anymore.
+func (w *webhooksReconciler) attempt(state *webhookState) {
+	w.lock.Lock()
+	removed := state.removed
+	w.lock.Unlock()
+	if removed {
+		return
+	}
+
+	err := w.client.RegisterWebhook(state.url)
+
+	if w.record(state, err) {
+		logrus.Infof("webhook for %s was unregistered while registering it, removing it again", state.url)
+		if err = w.client.UnregisterWebhook(state.url); err != nil {
+			logrus.Warnf("failed to unregister webhook for %s: %s", state.url, err)
+		}
+	}
+}
+
+// record updates the state with the result of registering its webhook, and
+// returns whether the webhook has to be removed again because the state was
+// unregistered in the meantime
+func (w *webhooksReconciler) record(state *webhookState, err error) bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if state.removed {
+		_, tracked := w.hooks[state.url.ToKey()]
+		return err == nil && !tracked
+	}
+
+	state.lastAttempt = time.Now()
+	state.lastError = err
+
+	if err != nil {
+		state.registered = false
+		state.nextAttempt = state.lastAttempt.Add(state.backoff.Duration())
+		logrus.Warnf("failed to register webhook for %s, retrying at %s: %s", state.url, state.nextAttempt.Format(time.RFC3339), err)
+
+		metrics.WebhookRegistered.WithLabelValues(state.url.ToPath()).Set(0)
+		metrics.WebhookLastErrorTimestamp.WithLabelValues(state.url.ToPath()).Set(float64(state.lastAttempt.Unix()))
+		return false
+	}
+
+	state.registered = true
+	state.backoff.Reset()
+	metrics.WebhookRegistered.WithLabelValues(state.url.ToPath()).Set(1)
+	return false
+}
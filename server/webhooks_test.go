@@ -0,0 +1,157 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"gitlab.com/yakshaving.art/git-pull-mirror/url"
+	"gitlab.com/yakshaving.art/git-pull-mirror/webhooks"
+)
+
+type fakeWebhooksClient struct {
+	lock         *sync.Mutex
+	failures     int
+	registered   map[string]int
+	unregistered map[string]int
+
+	// onRegister is called when registering, before the webhook is registered
+	onRegister func(u url.GitURL)
+	// onUnregister is called when unregistering, before the webhook is removed
+	onUnregister func(u url.GitURL)
+}
+
+func newFakeWebhooksClient(failures int) *fakeWebhooksClient {
+	return &fakeWebhooksClient{
+		lock:         &sync.Mutex{},
+		failures:     failures,
+		registered:   make(map[string]int),
+		unregistered: make(map[string]int),
+	}
+}
+
+func (f *fakeWebhooksClient) RegisterWebhook(u url.GitURL) error {
+	if f.onRegister != nil {
+		f.onRegister(u)
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.failures > 0 {
+		f.failures--
+		return fmt.Errorf("github is down")
+	}
+	f.registered[u.ToKey()]++
+	return nil
+}
+
+func (f *fakeWebhooksClient) UnregisterWebhook(u url.GitURL) error {
+	if f.onUnregister != nil {
+		f.onUnregister(u)
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.unregistered[u.ToKey()]++
+	return nil
+}
+
+func (f *fakeWebhooksClient) ListWebhooks() ([]url.GitURL, error) {
+	return nil, nil
+}
+
+func (f *fakeWebhooksClient) ParseHookPayload(payload string) (webhooks.HookPayload, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+
+func (f *fakeWebhooksClient) GetCallbackURL() string {
+	return "http://localhost/hooks"
+}
+
+func TestWebhooksReconcilerRetriesFailedRegistrations(t *testing.T) {
+	client := newFakeWebhooksClient(1)
+	w := newWebhooksReconciler(client, time.Hour)
+
+	u, err := url.Parse("https://github.com/yakshaving-art/git-pull-mirror.git")
+	must(t, "could not parse url", err)
+
+	w.Register(u)
+
+	status, ok := w.Status(u.ToKey())
+	if !ok {
+		t.Fatalf("webhook status for %s should be tracked", u.ToKey())
+	}
+	if status.Registered || status.LastError != "github is down" {
+		t.Fatalf("webhook should have failed to register, got %#v", status)
+	}
+
+	if due := w.due(time.Now()); len(due) != 0 {
+		t.Fatalf("failed registration should not be retried before backoff, got %d due", len(due))
+	}
+
+	for _, state := range w.due(time.Now().Add(time.Hour)) {
+		w.attempt(state)
+	}
+
+	status, _ = w.Status(u.ToKey())
+	if !status.Registered || status.LastError != "" {
+		t.Fatalf("webhook should be registered after retrying, got %#v", status)
+	}
+
+	if due := w.due(time.Now().Add(2 * time.Hour)); len(due) != 1 {
+		t.Fatalf("registered webhook should be verified after the verify interval, got %d due", len(due))
+	}
+
+	w.Unregister(u)
+	if _, ok := w.Status(u.ToKey()); ok {
+		t.Fatalf("webhook status for %s should not be tracked after unregistering", u.ToKey())
+	}
+	if client.unregistered[u.ToKey()] != 1 {
+		t.Fatalf("webhook should have been unregistered once, got %d", client.unregistered[u.ToKey()])
+	}
+}
+
+func TestWebhooksReconcilerDoesNotRegisterUnregisteredWebhooks(t *testing.T) {
+	client := newFakeWebhooksClient(1)
+	w := newWebhooksReconciler(client, time.Hour)
+
+	u, err := url.Parse("https://github.com/yakshaving-art/git-pull-mirror.git")
+	must(t, "could not parse url", err)
+
+	w.Register(u)
+	due := w.due(time.Now().Add(time.Hour))
+	if len(due) != 1 {
+		t.Fatalf("failed registration should be due, got %d due", len(due))
+	}
+
+	// Unregistered after the retry was picked up, but before it runs
+	w.Unregister(u)
+	for _, state := range due {
+		w.attempt(state)
+	}
+	if client.registered[u.ToKey()] != 0 {
+		t.Fatalf("unregistered webhook should not be registered again, got %d", client.registered[u.ToKey()])
+	}
+
+	// Unregistered while it is being registered, without holding the reconciler
+	// lock while the webhook is removed again
+	client.onRegister = func(u url.GitURL) {
+		client.onRegister = nil
+		w.Unregister(u)
+	}
+	client.onUnregister = func(u url.GitURL) {
+		w.Status(u.ToKey())
+	}
+	w.Register(u)
+	client.onUnregister = nil
+	if _, ok := w.Status(u.ToKey()); ok {
+		t.Fatalf("webhook status for %s should not be tracked after unregistering", u.ToKey())
+	}
+	if client.registered[u.ToKey()] != 1 || client.unregistered[u.ToKey()] != 3 {
+		t.Fatalf("webhook registered while unregistering should be removed again, got %d registrations and %d removals",
+			client.registered[u.ToKey()], client.unregistered[u.ToKey()])
+	}
+}
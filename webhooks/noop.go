@@ -0,0 +1,37 @@
+package webhooks
+
+import (
+	"fmt"
+
+	"gitlab.com/yakshaving.art/git-pull-mirror/url"
+)
+
+// NoopClient is a webhooks client that does not register anything, used when
+// the repositories are only kept up to date by polling
+type NoopClient struct{}
+
+// RegisterWebhook implements Client interface
+func (NoopClient) RegisterWebhook(url.GitURL) error {
+	return nil
+}
+
+// UnregisterWebhook implements Client interface
+func (NoopClient) UnregisterWebhook(url.GitURL) error {
+	return nil
+}
+
+// ListWebhooks implements Client interface
+func (NoopClient) ListWebhooks() ([]url.GitURL, error) {
+	return []url.GitURL{}, nil
+}
+
+// ParseHookPayload implements Client interface
+func (NoopClient) ParseHookPayload(payload string) (HookPayload, error) {
+	return nil, fmt.Errorf("webhooks are disabled")
+}
+
+// GetCallbackURL implements Client interface, there is no callback url when
+// webhooks are disabled
+func (NoopClient) GetCallbackURL() string {
+	return ""
+}
@@ -12,6 +12,8 @@ type HookPayload interface {
 // Client is a Webhooks client
 type Client interface {
 	RegisterWebhook(url.GitURL) error
+	UnregisterWebhook(url.GitURL) error
+	ListWebhooks() ([]url.GitURL, error)
 	ParseHookPayload(payload string) (HookPayload, error)
 	GetCallbackURL() string
 }